@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/knadh/niltalk/internal/logging"
+)
+
+// adminCfg represents the operators API configuration.
+type adminCfg struct {
+	Enabled bool `koanf:"enabled"`
+	// Token authenticates the requests as a bearer token.
+	Token string `koanf:"token"`
+	// Address of a separate listener, the app one is used when empty.
+	Address string `koanf:"address"`
+	// ClientCA authenticates the client certificates signed by it,
+	// the separate listener is then served over TLS.
+	ClientCA    string `koanf:"client_ca"`
+	Certificate string `koanf:"certificate"`
+	PrivateKey  string `koanf:"privatekey"`
+}
+
+type reqNotice struct {
+	Message string `json:"message"`
+}
+
+type reqMotd struct {
+	Motd string `json:"motd"`
+}
+
+// adminRouter returns the handlers of the operators API and dashboard.
+func (a *App) adminRouter(cfg adminCfg) http.Handler {
+	r := chi.NewRouter()
+	r.Get("/", wrap(handleAdminPage, a, 0))
+	r.Route("/api", func(r chi.Router) {
+		r.Use(adminAuth(cfg))
+		r.Get("/rooms", wrap(handleAdminRooms, a, 0))
+		r.Delete("/rooms/{roomID}", wrap(handleAdminDispose, a, hasRoom))
+		r.Post("/rooms/{roomID}/notice", wrap(handleAdminNotice, a, hasRoom))
+		r.Put("/rooms/{roomID}/motd", wrap(handleAdminMotd, a, hasRoom))
+		r.Post("/notice", wrap(handleAdminNotice, a, 0))
+	})
+	return r
+}
+
+// serveAdmin serves the operators API on its own listener, over TLS
+// authenticating the client certificates if a client CA is configured.
+func serveAdmin(cfg adminCfg, h http.Handler) (*http.Server, error) {
+	ln, err := net.Listen("tcp", cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: h}
+	if cfg.ClientCA == "" {
+		logger.Printf("starting admin server on http://%v/admin", ln.Addr().String())
+		go func() {
+			if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+				logger.Fatalf("couldn't serve admin: %v", err)
+			}
+		}()
+		return srv, nil
+	}
+
+	pem, err := ioutil.ReadFile(cfg.ClientCA)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		ln.Close()
+		return nil, fmt.Errorf("no certificate found in %q", cfg.ClientCA)
+	}
+	srv.TLSConfig = tlsConfig(nil)
+	srv.TLSConfig.ClientCAs = pool
+	srv.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+
+	logger.Printf("starting admin server on https://%v/admin", ln.Addr().String())
+	go func() {
+		if err := srv.ServeTLS(ln, cfg.Certificate, cfg.PrivateKey); err != nil && err != http.ErrServerClosed {
+			logger.Fatalf("couldn't tls serve admin: %v", err)
+		}
+	}()
+	return srv, nil
+}
+
+// validateAdminCfg checks that the operators API can not be reached
+// without authentication.
+func validateAdminCfg(cfg adminCfg) error {
+	if cfg.Token == "" && cfg.ClientCA == "" {
+		return errors.New("admin.token or admin.client_ca is required")
+	}
+	if cfg.ClientCA != "" && (cfg.Address == "" || cfg.Certificate == "" || cfg.PrivateKey == "") {
+		return errors.New("admin.client_ca requires admin.address, admin.certificate and admin.privatekey")
+	}
+	return nil
+}
+
+// adminAuth is a middleware that authenticates the operators by their
+// bearer token or their verified client certificate.
+func adminAuth(cfg adminCfg) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if cfg.ClientCA != "" && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			tok := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if cfg.Token != "" && subtle.ConstantTimeCompare([]byte(tok), []byte(cfg.Token)) == 1 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			respondJSON(w, nil, errors.New("unauthorized"), http.StatusUnauthorized)
+		})
+	}
+}
+
+// handleAdminPage renders the operators dashboard.
+func handleAdminPage(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx = r.Context().Value("ctx").(*reqCtx)
+		app = ctx.app
+	)
+	respondHTML("admin", tplData{Title: "Admin"}, http.StatusOK, w, app)
+}
+
+// handleAdminRooms lists the active rooms.
+func handleAdminRooms(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx = r.Context().Value("ctx").(*reqCtx)
+		app = ctx.app
+	)
+	respondJSON(w, app.hub.Rooms(), nil, http.StatusOK)
+}
+
+// handleAdminDispose disposes of a room, disconnecting its peers.
+func handleAdminDispose(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context().Value("ctx").(*reqCtx)
+		app  = ctx.app
+		room = ctx.room
+	)
+	if room == nil {
+		respondJSON(w, nil, errors.New("room not found"), http.StatusNotFound)
+		return
+	}
+	if room.Predefined {
+		respondJSON(w, nil, errors.New("predefined rooms are removed from the configuration"), http.StatusBadRequest)
+		return
+	}
+	room.Dispose()
+	app.logger.Info("admin disposed of room", "room", logging.ID(room.ID))
+	respondJSON(w, true, nil, http.StatusOK)
+}
+
+// handleAdminNotice broadcasts a notice to the peers of a room,
+// or of all the rooms.
+func handleAdminNotice(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context().Value("ctx").(*reqCtx)
+		app  = ctx.app
+		room = ctx.room
+	)
+	var req reqNotice
+	if err := readJSONReq(r, &req); err != nil {
+		respondJSON(w, nil, errors.New("error parsing JSON request"), http.StatusBadRequest)
+		return
+	}
+	if req.Message == "" {
+		respondJSON(w, nil, errors.New("empty message"), http.StatusBadRequest)
+		return
+	}
+
+	if chi.URLParam(r, "roomID") == "" {
+		app.hub.BroadcastNotice(req.Message)
+		app.logger.Printf("admin sent a notice to all rooms")
+		respondJSON(w, true, nil, http.StatusOK)
+		return
+	}
+
+	if room == nil {
+		respondJSON(w, nil, errors.New("room not found"), http.StatusNotFound)
+		return
+	}
+	go room.BroadcastNotice(req.Message)
+	app.logger.Info("admin sent a notice to room", "room", logging.ID(room.ID))
+	respondJSON(w, true, nil, http.StatusOK)
+}
+
+// handleAdminMotd changes the message of the day of a predefined room
+// until the next restart or configuration reload.
+func handleAdminMotd(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx  = r.Context().Value("ctx").(*reqCtx)
+		app  = ctx.app
+		room = ctx.room
+	)
+	if room == nil {
+		respondJSON(w, nil, errors.New("room not found"), http.StatusNotFound)
+		return
+	}
+	if !room.Predefined {
+		respondJSON(w, nil, errors.New("only predefined rooms have a message of the day"), http.StatusBadRequest)
+		return
+	}
+	var req reqMotd
+	if err := readJSONReq(r, &req); err != nil {
+		respondJSON(w, nil, errors.New("error parsing JSON request"), http.StatusBadRequest)
+		return
+	}
+	room.SetMotd(req.Motd)
+	app.logger.Info("admin changed the motd of room", "room", logging.ID(room.ID))
+	respondJSON(w, true, nil, http.StatusOK)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/knadh/niltalk/store/redis"
+)
+
+// clusterCfg represents the cluster mode configuration.
+type clusterCfg struct {
+	Enabled   bool          `koanf:"enabled"`
+	Channel   string        `koanf:"channel"`
+	Heartbeat time.Duration `koanf:"heartbeat"`
+}
+
+// joinCluster relays the hub events to the other instances through
+// Redis pub/sub, using the Redis store configuration.
+func (a *App) joinCluster(cfg clusterCfg) error {
+	if a.cfg.Storage != "redis" {
+		return errors.New("cluster mode requires app.storage = \"redis\"")
+	}
+	if cfg.Channel == "" {
+		cfg.Channel = "NIL:CLUSTER"
+	}
+	if cfg.Heartbeat == 0 {
+		cfg.Heartbeat = 5 * time.Second
+	}
+
+	var storeCfg redis.Config
+	if err := ko.Unmarshal("store", &storeCfg); err != nil {
+		return err
+	}
+	ps, err := redis.NewPubSub(storeCfg, cfg.Channel, logger.Std())
+	if err != nil {
+		return err
+	}
+	if err := a.hub.EnableCluster(ps, cfg.Heartbeat); err != nil {
+		ps.Close()
+		return err
+	}
+	return nil
+}
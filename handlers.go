@@ -7,9 +7,8 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"mime/multipart"
 	"net/http"
-	"strings"
+	"strconv"
 	"sync"
 	"time"
 
@@ -18,6 +17,7 @@ import (
 	"github.com/go-chi/chi"
 	"github.com/gorilla/websocket"
 	"github.com/knadh/niltalk/internal/hub"
+	"github.com/knadh/niltalk/internal/logging"
 	"github.com/knadh/niltalk/internal/upload"
 	"github.com/knadh/niltalk/store"
 	"golang.org/x/time/rate"
@@ -33,6 +33,8 @@ type reqCtx struct {
 	app  *App
 	room *hub.Room
 	sess store.Sess
+	// authed is set if the session is of a peer connected to the room.
+	authed bool
 }
 
 // jsonResp is the envelope for all JSON API responses.
@@ -48,12 +50,27 @@ type tplData struct {
 }
 
 type reqRoom struct {
-	Name string `json:"name"`
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	// Lifecycle of the room: the idle timeout in seconds, the absolute
+	// expiry, and the hours after the first peer joined it self-destructs.
+	IdleTimeout int       `json:"idle_timeout"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	BurnAfter   int       `json:"burn_after"`
+	// MessageTTL is the longest lifetime of the messages in seconds.
+	MessageTTL int `json:"message_ttl"`
+	// Proof of work solution, if the server requires one.
+	PowChallenge string `json:"pow_challenge"`
+	PowNonce     string `json:"pow_nonce"`
 }
 
 type reqLogin struct {
 	PublicKey string `json:"publickey"`
 	Secret    string `json:"secret"`
+	Handle    string `json:"handle"`
+	Password  string `json:"password"`
+	// OwnerToken claims the ownership of the room for the peer.
+	OwnerToken string `json:"owner_token"`
 }
 
 var upgrader = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool {
@@ -67,7 +84,7 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
 		app = ctx.app
 	)
 	respondHTML("index", tplData{
-		Title: app.cfg.Name,
+		Title: app.hub.Config().Name,
 	}, http.StatusOK, w, app)
 }
 
@@ -128,36 +145,43 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 
 	if req.PublicKey == "" {
 		err := errors.New("missing publickey")
-		app.logger.Printf("error handling logging: %v", err)
+		app.logger.Warn("error handling login", "room", logging.ID(room.ID), "err", err)
 		respondJSON(w, nil, err, http.StatusInternalServerError)
 		return
 	}
 
-	peer, err := room.Login(req.Secret, req.PublicKey)
+	var (
+		peer        *hub.Peer
+		sealedAuths map[string]hub.SealedMsg
+		handle      string
+		err         error
+	)
+	if al := r.URL.Query().Get("al"); al != "" {
+		peer, handle, sealedAuths, err = room.LoginWithToken(al, req.Secret, req.PublicKey)
+	} else {
+		peer, err = room.Login(req.Secret, req.PublicKey, req.Handle, req.Password)
+	}
 	if err == hub.ErrInvalidRoomPassword || err == hub.ErrInvalidUserPassword {
 		respondJSON(w, nil, errors.New("incorrect password"), http.StatusForbidden)
 		return
+	} else if err == hub.ErrInvalidToken || err == hub.ErrBanned {
+		respondJSON(w, nil, err, http.StatusForbidden)
+		return
+	} else if err == hub.ErrRoomStopped {
+		respondJSON(w, nil, errors.New("room is invalid or has expired"), http.StatusBadRequest)
+		return
 	} else if err != nil {
 		respondJSON(w, nil, err, http.StatusInternalServerError)
 		return
 	}
 
-	var sealedAuths map[string]hub.SealedMsg
-	var handle string
-	al := r.URL.Query().Get("al")
-	if al != "" {
-		h, s, err := room.GetLoginTokens(al)
-		if err != nil {
-			respondJSON(w, nil, err, http.StatusInternalServerError)
-			return
-		}
-		handle = h
-		sealedAuths = s
+	if req.OwnerToken != "" && !room.ClaimOwner(peer.PublicKey, req.OwnerToken) {
+		app.logger.Warn("invalid owner token", "room", logging.ID(room.ID))
 	}
 
 	// Set the session cookie.
 	ck := &http.Cookie{
-		Name:  app.cfg.SessionCookie,
+		Name:  app.hub.Config().SessionCookie,
 		Value: req.PublicKey,
 		Path:  fmt.Sprintf("/r/%v", room.ID),
 	}
@@ -169,12 +193,14 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 		ServerPubKey string                   `json:"serverpubkey"`
 		Handle       string                   `json:"handle"`
 		SealedAuths  map[string]hub.SealedMsg `json:"sealedauths"`
+		Owner        bool                     `json:"owner"`
 	}{
 		Secret:       peer.Secret,
 		Since:        peer.Since.Format(hub.JSDateFormat),
 		ServerPubKey: base64.StdEncoding.EncodeToString(room.PubKey[:]),
 		SealedAuths:  sealedAuths,
 		Handle:       handle,
+		Owner:        room.IsOwner(peer.PublicKey),
 	}
 	respondJSON(w, res, nil, http.StatusOK)
 }
@@ -194,7 +220,7 @@ func handleLogout(w http.ResponseWriter, r *http.Request) {
 
 	// Delete the session cookie.
 	ck := &http.Cookie{
-		Name:   app.cfg.SessionCookie,
+		Name:   app.hub.Config().SessionCookie,
 		Value:  "",
 		MaxAge: -1,
 		Path:   fmt.Sprintf("/r/%v", room.ID),
@@ -214,7 +240,7 @@ func handleWS(w http.ResponseWriter, r *http.Request) {
 	// Create the WS connection.
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		app.logger.Printf("Websocket upgrade failed: %s: %v", r.RemoteAddr, err)
+		app.logger.Warn("websocket upgrade failed", "addr", logging.ID(r.RemoteAddr), "err", err)
 		return
 	}
 
@@ -263,7 +289,7 @@ func respondHTML(tplName string, data tplData, statusCode int, w http.ResponseWr
 		QRConfig qrConfig
 		Data     tplData
 	}{
-		Config:   app.cfg,
+		Config:   app.hub.Config(),
 		QRConfig: app.qrConfig,
 		Data:     data,
 	})
@@ -291,16 +317,63 @@ func handleCreateRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	opt := hub.RoomOptions{
+		IdleTimeout: time.Duration(req.IdleTimeout) * time.Second,
+		ExpiresAt:   req.ExpiresAt,
+		BurnAfter:   time.Duration(req.BurnAfter) * time.Hour,
+		MessageTTL:  time.Duration(req.MessageTTL) * time.Second,
+	}
+	if err := opt.Validate(app.hub.Config()); err != nil {
+		respondJSON(w, nil, err, http.StatusBadRequest)
+		return
+	}
+
+	if err := app.roomLimiter.checkPow(req.PowChallenge, req.PowNonce); err != nil {
+		respondJSON(w, nil, err, http.StatusForbidden)
+		return
+	}
+	if !app.roomLimiter.allow(r) {
+		respondJSON(w, nil, errCreationRateLimited, http.StatusTooManyRequests)
+		return
+	}
+
 	// Create and activate the new room.
-	room, err := app.hub.AddRoom(req.Name)
-	if err != nil {
+	room, ownerToken, err := app.hub.AddRoom(req.Name, req.Password, opt)
+	if err == hub.ErrMaxRooms {
+		respondJSON(w, nil, err, http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
 		respondJSON(w, nil, err, http.StatusInternalServerError)
 		return
 	}
 
 	respondJSON(w, struct {
-		ID string `json:"id"`
-	}{room.ID}, nil, http.StatusOK)
+		ID         string `json:"id"`
+		OwnerToken string `json:"owner_token"`
+	}{room.ID, ownerToken}, nil, http.StatusOK)
+}
+
+// handleRoomChallenge returns a proof of work challenge to solve
+// before creating a room, with a difficulty of 0 if none is required.
+func handleRoomChallenge(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx = r.Context().Value("ctx").(*reqCtx)
+		app = ctx.app
+	)
+
+	out := struct {
+		Challenge  string `json:"challenge"`
+		Difficulty int    `json:"difficulty"`
+	}{Difficulty: app.roomLimiter.cfg.PowDifficulty}
+	if out.Difficulty > 0 {
+		c, err := app.roomLimiter.challenge()
+		if err != nil {
+			respondJSON(w, nil, errors.New("error generating challenge"), http.StatusInternalServerError)
+			return
+		}
+		out.Challenge = c
+	}
+	respondJSON(w, out, nil, http.StatusOK)
 }
 
 // wrap is a middleware that handles auth and room check for various HTTP handlers.
@@ -322,13 +395,12 @@ func wrap(next http.HandlerFunc, app *App, opts uint8) http.HandlerFunc {
 
 		// Check if the request is authenticated.
 		if opts&hasAuth != 0 && req.room != nil {
-			ck, _ := r.Cookie(app.cfg.SessionCookie)
+			ck, _ := r.Cookie(app.hub.Config().SessionCookie)
 			if ck != nil {
 				if ck.Value != "" {
-					var ok bool
-					req.sess, ok = req.room.GetSession(ck.Value)
-					if !ok {
-						app.logger.Printf("session not found in room %q for public key: %v", roomID, ck.Value)
+					req.sess, req.authed = req.room.GetSession(ck.Value)
+					if !req.authed {
+						app.logger.Debug("session not found", "room", logging.ID(roomID), "peer", logging.ID(ck.Value))
 					}
 				}
 				req.sess.PublicKey = ck.Value
@@ -351,8 +423,45 @@ func readJSONReq(r *http.Request, o interface{}) error {
 	return json.Unmarshal(b, o)
 }
 
-// handleUpload handles file uploads.
-func handleUpload(store *upload.Store) func(w http.ResponseWriter, r *http.Request) {
+// uploadCtx returns the context of an upload request, or responds with an
+// error if the room is invalid or the caller is not one of its peers.
+func uploadCtx(w http.ResponseWriter, r *http.Request) (*reqCtx, bool) {
+	ctx := r.Context().Value("ctx").(*reqCtx)
+	if ctx.room == nil {
+		respondJSON(w, nil, errors.New("room is invalid or has expired"), http.StatusNotFound)
+		return nil, false
+	}
+	if !ctx.authed {
+		respondJSON(w, nil, errors.New("invalid session"), http.StatusForbidden)
+		return nil, false
+	}
+	return ctx, true
+}
+
+// respondUploadErr responds to an upload request with an error.
+func respondUploadErr(w http.ResponseWriter, err error) {
+	s := http.StatusInternalServerError
+	switch err {
+	case upload.ErrUploadNotFound, upload.ErrFileNotFound:
+		s = http.StatusNotFound
+	case upload.ErrOffsetMismatch, upload.ErrUploadBusy:
+		s = http.StatusConflict
+	case upload.ErrUploadIncomplete, upload.ErrInvalidLength:
+		s = http.StatusBadRequest
+	case upload.ErrFileTooLarge:
+		s = http.StatusRequestEntityTooLarge
+	case upload.ErrTooManyUploads:
+		s = http.StatusTooManyRequests
+	default:
+		logger.Error("upload failed", "err", err)
+		err = errors.New("upload failed")
+	}
+	respondJSON(w, nil, err, s)
+}
+
+// handleUploadCreate starts a chunked upload of the length given by the
+// Upload-Length header. The chunks are then sent to the returned location.
+func handleUploadCreate(store *upload.Store) func(w http.ResponseWriter, r *http.Request) {
 
 	type roomLimiter struct {
 		limiter *rate.Limiter
@@ -376,109 +485,158 @@ func handleUpload(store *upload.Store) func(w http.ResponseWriter, r *http.Reque
 	}()
 
 	return func(w http.ResponseWriter, r *http.Request) {
-		err := r.ParseMultipartForm(store.MaxUploadSize)
+		ctx, ok := uploadCtx(w, r)
+		if !ok {
+			return
+		}
 
-		if err == nil {
-			roomID := chi.URLParam(r, "roomID")
-			mu.Lock()
-			// no defer here becasue file upload can be slow, thus lock for too long
-			x, ok := roomLimiters[roomID]
-			if !ok {
-				x = roomLimiter{
-					limiter: rate.NewLimiter(rate.Every(store.RlPeriod/time.Duration(store.RlCount)), store.RlBurst),
-					expire:  time.Now().Add(time.Minute * 10),
-				}
-				roomLimiters[roomID] = x
-			}
-			x.expire = time.Now().Add(time.Minute * 10)
-			roomLimiters[roomID] = x
-			mu.Unlock()
-			if !x.limiter.Allow() {
-				err = errors.New(http.StatusText(http.StatusTooManyRequests))
+		roomID := ctx.room.ID
+		mu.Lock()
+		x, ok := roomLimiters[roomID]
+		if !ok {
+			x = roomLimiter{
+				limiter: rate.NewLimiter(rate.Every(store.RlPeriod/time.Duration(store.RlCount)), store.RlBurst),
 			}
 		}
+		x.expire = time.Now().Add(time.Minute * 10)
+		roomLimiters[roomID] = x
+		mu.Unlock()
+		if !x.limiter.Allow() {
+			respondJSON(w, nil, errors.New(http.StatusText(http.StatusTooManyRequests)), http.StatusTooManyRequests)
+			return
+		}
 
-		type fileRes struct {
-			ID       string `json:"id"`
-			Err      string `json:"err"`
-			MimeType string `json:"mimetype"`
-			Name     string `json:"name"`
+		length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+		if err != nil {
+			respondJSON(w, nil, errors.New("invalid Upload-Length"), http.StatusBadRequest)
+			return
 		}
-		res := map[string]fileRes{}
-		if err == nil {
-			var files []multipart.File
-			var handlers []*multipart.FileHeader
-			for i := 0; i < 20; i++ {
-				key := fmt.Sprintf("file%v", i)
-				file, handler, e := r.FormFile(key)
-				if e == http.ErrMissingFile {
-					// all files were processed.
-					break
-				}
-				if e != nil {
-					err = e
-				}
-				if err != nil {
-					break
-				}
-				defer file.Close()
-				files = append(files, file)
-				handlers = append(handlers, handler)
-			}
-			if err == nil {
-				for i, file := range files {
-					handler := handlers[i]
-					b, e := ioutil.ReadAll(file)
-					if e != nil {
-						res[handler.Filename] = fileRes{Err: e.Error()}
-						continue
-					}
-					name := handler.Filename
-					mimeType := http.DetectContentType(b)
-					up, e := store.Add(name, mimeType, b)
-					if e != nil {
-						res[handler.Filename] = fileRes{Err: e.Error(), MimeType: mimeType, Name: name}
-						continue
-					}
-					res[handler.Filename] = fileRes{ID: fmt.Sprintf("%v_%v", up.ID, up.Name), MimeType: mimeType, Name: name}
-				}
-			}
+		id, err := store.Create(roomID, ctx.sess.PublicKey, length)
+		if err != nil {
+			respondUploadErr(w, err)
+			return
 		}
+		w.Header().Set("Location", fmt.Sprintf("/r/%s/uploads/%s", roomID, id))
+		respondJSON(w, struct {
+			ID string `json:"id"`
+		}{id}, nil, http.StatusCreated)
+	}
+}
 
-		s := http.StatusOK
+// handleUploadStatus returns the offset of an upload to resume it.
+func handleUploadStatus(store *upload.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, ok := uploadCtx(w, r)
+		if !ok {
+			return
+		}
+		offset, length, err := store.Status(ctx.room.ID, ctx.sess.PublicKey, chi.URLParam(r, "uploadID"))
 		if err != nil {
-			s = http.StatusBadRequest
+			respondUploadErr(w, err)
+			return
 		}
-		respondJSON(w, res, err, s)
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(length, 10))
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
 	}
 }
 
-// handleUploaded uploaded files display.
+// handleUploadChunk streams a chunk of an upload, starting at the offset
+// given by the Upload-Offset header, to the staged file.
+func handleUploadChunk(store *upload.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, ok := uploadCtx(w, r)
+		if !ok {
+			return
+		}
+		if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+			respondJSON(w, nil, errors.New("invalid Content-Type"), http.StatusUnsupportedMediaType)
+			return
+		}
+		offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil {
+			respondJSON(w, nil, errors.New("invalid Upload-Offset"), http.StatusBadRequest)
+			return
+		}
+
+		defer r.Body.Close()
+		offset, err = store.Append(ctx.room.ID, ctx.sess.PublicKey, chi.URLParam(r, "uploadID"), offset, r.Body)
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		if err != nil {
+			respondUploadErr(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleUploadFinalize stores a complete upload as a file.
+func handleUploadFinalize(store *upload.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, ok := uploadCtx(w, r)
+		if !ok {
+			return
+		}
+		up, err := store.Finalize(ctx.room.ID, ctx.sess.PublicKey, chi.URLParam(r, "uploadID"))
+		if err != nil {
+			respondUploadErr(w, err)
+			return
+		}
+		respondJSON(w, struct {
+			ID   string `json:"id"`
+			Size int64  `json:"size"`
+		}{up.ID, up.Size}, nil, http.StatusOK)
+	}
+}
+
+// handleUploadAbort cancels an upload.
+func handleUploadAbort(store *upload.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, ok := uploadCtx(w, r)
+		if !ok {
+			return
+		}
+		if err := store.Abort(ctx.room.ID, ctx.sess.PublicKey, chi.URLParam(r, "uploadID")); err != nil {
+			respondUploadErr(w, err)
+			return
+		}
+		respondJSON(w, true, nil, http.StatusOK)
+	}
+}
+
+// handleUploaded serves the uploaded files, with range requests.
 func handleUploaded(store *upload.Store) func(w http.ResponseWriter, r *http.Request) {
-	maxAgeHeader := fmt.Sprintf("max-age=%v", int64(store.MaxAge/time.Second))
+	maxAgeHeader := fmt.Sprintf("private, max-age=%v", int64(store.MaxAge/time.Second))
 	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context().Value("ctx").(*reqCtx)
+		if ctx.room == nil || !ctx.authed {
+			respondJSON(w, nil, errors.New("file not found"), http.StatusNotFound)
+			return
+		}
+
 		fileID := chi.URLParam(r, "fileID")
-		fileID = strings.Split(fileID, "_")[0]
-		up, err := store.Get(fileID)
-		if err != nil {
-			logger.Printf("failed to fetch uploaded file %q from the store: %v", fileID, err)
+		up, blob, err := store.Open(ctx.room.ID, fileID)
+		if err == upload.ErrFileNotFound {
 			respondJSON(w, nil, errors.New("file not found"), http.StatusNotFound)
 			return
 		}
-		w.Header().Add("Content-Type", up.MimeType)
-		switch up.MimeType {
-		case "image/jpeg", "image/png", "image/gif", "application/pdf":
-		default:
-			w.Header().Add("Content-Disposition", fmt.Sprintf("attachment; filename=%q", up.Name))
-			w.Header().Add("Content-Transfer-Encoding", "binary")
-			w.Header().Add("Accept-Ranges", "bytes")
+		if err != nil {
+			logger.Error("failed to fetch uploaded file from the store", "file", logging.ID(fileID), "err", err)
+			respondJSON(w, nil, errors.New("error fetching the file"), http.StatusInternalServerError)
+			return
 		}
-		w.Header().Add("Content-Length", fmt.Sprint(len(up.Data)))
+		defer blob.Close()
+
+		// The blob is ciphertext, only the clients know what it is
+		// and display it once decrypted.
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", "attachment")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
 		if store.MaxAge > 0 {
-			w.Header().Add("Cache-Control", maxAgeHeader)
+			w.Header().Set("Cache-Control", maxAgeHeader)
 		}
-		w.WriteHeader(http.StatusOK)
-		w.Write(up.Data)
+		http.ServeContent(w, r, "", up.CreatedAt, blob)
 	}
 }
 
@@ -0,0 +1,169 @@
+package hub
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"sort"
+
+	"github.com/gorilla/websocket"
+	"github.com/knadh/niltalk/internal/logging"
+)
+
+// adminMsg notifies the peers of an administration action.
+type adminMsg struct {
+	Type      string `json:"type"`
+	PublicKey string `json:"publicKey"`
+	Owner     string `json:"owner"`
+}
+
+// adminState is the administration state of a room.
+type adminState struct {
+	Owner  string   `json:"owner"`
+	Banned []string `json:"banned"`
+	Muted  []string `json:"muted"`
+}
+
+// ClaimOwner makes the peer the owner of the room if the token is
+// the one issued to the creator of the room.
+func (r *Room) ClaimOwner(publicKey, token string) bool {
+	if len(r.ownerToken) == 0 || subtle.ConstantTimeCompare(hashToken(token), r.ownerToken) != 1 {
+		return false
+	}
+	r.setOwnerSync(publicKey)
+	return true
+}
+
+// IsOwner returns true if the peer owns the room.
+func (r *Room) IsOwner(publicKey string) bool {
+	var ok bool
+	r.do(func() {
+		ok = r.owner == publicKey
+	})
+	return ok
+}
+
+// setOwnerSync makes the peer the owner of the room from outside of the room loop.
+func (r *Room) setOwnerSync(publicKey string) {
+	r.do(func() {
+		if r.owner != publicKey {
+			r.owner = publicKey
+			r.adminChanged(adminMsg{Type: TypeRoomOwner, PublicKey: publicKey, Owner: publicKey})
+		}
+	})
+}
+
+// handleAdmin processes an administration request of a peer.
+// It must be called from the room loop.
+func (r *Room) handleAdmin(peer *Peer, typ, target string) {
+	if peer.PublicKey != r.owner {
+		r.sendNotice(peer, "Only the owner of the room can do that.")
+		return
+	}
+	if target == "" || target == peer.PublicKey {
+		r.sendNotice(peer, "Invalid peer.")
+		return
+	}
+
+	switch typ {
+	case TypePeerKick:
+		if !r.kickPeer(target, TypePeerKick) {
+			r.sendNotice(peer, "Peer not found.")
+			return
+		}
+	case TypePeerBan:
+		r.banned[target] = true
+		r.kickPeer(target, TypePeerBan)
+	case TypePeerUnban:
+		delete(r.banned, target)
+	case TypePeerMute:
+		r.muted[target] = true
+	case TypePeerUnmute:
+		delete(r.muted, target)
+	case TypeRoomOwner:
+		if r.peers.byPublicKey(target) == nil && r.remotePeers[target].node == "" {
+			r.sendNotice(peer, "Peer not found.")
+			return
+		}
+		r.owner = target
+	}
+	r.adminChanged(adminMsg{Type: typ, PublicKey: target, Owner: r.owner})
+}
+
+// adminChanged persists the administration state of the room, relays it
+// to the other instances of the cluster, and notifies the peers.
+// It must be called from the room loop.
+func (r *Room) adminChanged(m adminMsg) {
+	if !r.Predefined {
+		if err := r.hub.saveRoom(r); err != nil {
+			r.hub.log.Error("error saving room to the store", "room", logging.ID(r.ID), "err", err)
+		}
+	}
+	b, _ := json.Marshal(adminState{
+		Owner:  r.owner,
+		Banned: setList(r.banned),
+		Muted:  setList(r.muted),
+	})
+	r.hub.publish(clusterEvent{Type: evRoomAdmin, Room: r.ID, Data: b})
+	go r.BroadcastUnsealed(m)
+}
+
+// setAdminState applies the administration state relayed by another instance.
+func (r *Room) setAdminState(b []byte) {
+	var s adminState
+	if err := json.Unmarshal(b, &s); err != nil {
+		r.hub.log.Warn("invalid room administration state", "room", logging.ID(r.ID), "err", err)
+		return
+	}
+	r.owner = s.Owner
+	r.banned = toSet(s.Banned)
+	r.muted = toSet(s.Muted)
+}
+
+// kickPeer disconnects a peer with the given reason, relaying the request
+// to the other instances if it is not connected here. It returns false
+// if the peer is not in the room. It must be called from the room loop.
+func (r *Room) kickPeer(publicKey, reason string) bool {
+	p := r.peers.byPublicKey(publicKey)
+	if p == nil {
+		if r.remotePeers[publicKey].node == "" {
+			return false
+		}
+		r.hub.publish(clusterEvent{Type: evPeerKick, Room: r.ID, Peer: &peerMsg{Type: reason, PublicKey: publicKey}})
+		return true
+	}
+	r.disconnectPeer(p, reason)
+	return true
+}
+
+// disconnectPeer closes the connection of a local peer with the given reason.
+// It must be called from the room loop.
+func (r *Room) disconnectPeer(p *Peer, reason string) {
+	r.hub.log.Info("peer disconnected", "room", logging.ID(r.ID), "peer", logging.ID(p.PublicKey), "reason", reason)
+	if p.ws == nil {
+		// Logged in but not connected.
+		r.removePeer(p)
+		return
+	}
+	p.writeWSControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason))
+	p.ws.Close()
+}
+
+// toSet returns a set of the given strings.
+func toSet(l []string) map[string]bool {
+	out := make(map[string]bool, len(l))
+	for _, s := range l {
+		out[s] = true
+	}
+	return out
+}
+
+// setList returns the sorted strings of a set.
+func setList(m map[string]bool) []string {
+	out := make([]string, 0, len(m))
+	for s := range m {
+		out = append(out, s)
+	}
+	sort.Strings(out)
+	return out
+}
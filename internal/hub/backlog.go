@@ -0,0 +1,137 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/knadh/niltalk/internal/logging"
+)
+
+// keyBacklog is the key format of the persisted backlog of a predefined room.
+const keyBacklog = "BACKLOG:%s"
+
+// backlog is a bounded ring of the sealed messages addressed to a room,
+// replayed to the peers when they connect. The server can not read them.
+type backlog struct {
+	msgs  []backlogMsg
+	next  int
+	full  bool
+	dirty bool
+}
+
+// backlogMsg is an encoded message and its expiry, zero if it does not expire.
+type backlogMsg struct {
+	data      []byte
+	expiresAt time.Time
+}
+
+func newBacklog(size int) *backlog {
+	if size < 0 {
+		size = 0
+	}
+	return &backlog{msgs: make([]backlogMsg, size)}
+}
+
+// add a message, overwriting the oldest one when the ring is full.
+func (b *backlog) add(m []byte, exp time.Time) {
+	if len(b.msgs) == 0 {
+		return
+	}
+	b.msgs[b.next] = backlogMsg{data: m, expiresAt: exp}
+	b.next = (b.next + 1) % len(b.msgs)
+	if b.next == 0 {
+		b.full = true
+	}
+	b.dirty = true
+}
+
+// list returns the messages not expired at now, oldest first.
+func (b *backlog) list(now time.Time) []backlogMsg {
+	all := b.msgs[:b.next]
+	if b.full {
+		all = append(append([]backlogMsg{}, b.msgs[b.next:]...), b.msgs[:b.next]...)
+	}
+	out := make([]backlogMsg, 0, len(all))
+	for _, m := range all {
+		if m.expiresAt.IsZero() || m.expiresAt.After(now) {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// prune removes the messages expired at now.
+func (b *backlog) prune(now time.Time) {
+	msgs := b.list(now)
+	if len(msgs) == b.len() {
+		return
+	}
+	for i := range b.msgs {
+		b.msgs[i] = backlogMsg{}
+	}
+	b.next, b.full = 0, false
+	for _, m := range msgs {
+		b.add(m.data, m.expiresAt)
+	}
+	b.dirty = true
+}
+
+// len returns the number of messages, expired or not.
+func (b *backlog) len() int {
+	if b.full {
+		return len(b.msgs)
+	}
+	return b.next
+}
+
+// loadBacklog restores the persisted backlog of the room.
+func (r *Room) loadBacklog() error {
+	d, err := r.hub.store.Get(fmt.Sprintf(keyBacklog, r.ID))
+	if len(d) == 0 || err != nil {
+		// Nothing was persisted yet.
+		return nil
+	}
+	var msgs []json.RawMessage
+	if err := json.Unmarshal(d, &msgs); err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, m := range msgs {
+		// The expiry is read back from the envelope it was stamped on.
+		var env SealedMsg
+		if err := json.Unmarshal(m, &env); err != nil {
+			continue
+		}
+		exp := env.expiry()
+		if !exp.IsZero() && !exp.After(now) {
+			continue
+		}
+		r.backlog.add(m, exp)
+	}
+	r.backlog.dirty = false
+	return nil
+}
+
+// saveBacklog persists the backlog of the room if it has changed.
+// In cluster mode, only the owner of the room writes it.
+func (r *Room) saveBacklog() {
+	if !r.persistBacklog || !r.backlog.dirty || !r.hub.ownsRoom(r.ID) {
+		return
+	}
+	msgs := r.backlog.list(time.Now())
+	raw := make([]json.RawMessage, len(msgs))
+	for i, m := range msgs {
+		raw[i] = m.data
+	}
+	b, err := json.Marshal(raw)
+	if err != nil {
+		r.hub.log.Error("error encoding the room backlog", "room", logging.ID(r.ID), "err", err)
+		return
+	}
+	if err := r.hub.store.Set(fmt.Sprintf(keyBacklog, r.ID), b); err != nil {
+		r.hub.log.Error("error saving the room backlog", "room", logging.ID(r.ID), "err", err)
+		return
+	}
+	r.backlog.dirty = false
+}
@@ -0,0 +1,232 @@
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// Types of events relayed between the instances of a cluster.
+const (
+	evNodeAlive       = "node.alive"
+	evNodeLeave       = "node.leave"
+	evRoomSync        = "room.sync"
+	evRoomDispose     = "room.dispose"
+	evRoomAdmin       = "room.admin"
+	evPeerKick        = "peer.kick"
+	evPeerJoin        = "peer.join"
+	evPeerLeave       = "peer.leave"
+	evForward         = "forward"
+	evBroadcast       = "broadcast"
+	evBroadcastSealed = "broadcast.sealed"
+)
+
+// Broker relays messages between the instances of a cluster.
+type Broker interface {
+	// Publish a message to all the instances.
+	Publish(msg []byte) error
+	// Subscribe calls fn for each message published by any instance.
+	Subscribe(fn func(msg []byte)) error
+	Close() error
+}
+
+// clusterEvent is a room event relayed to the other instances.
+type clusterEvent struct {
+	Type string          `json:"type"`
+	Node string          `json:"node"`
+	Room string          `json:"room,omitempty"`
+	Peer *peerMsg        `json:"peer,omitempty"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// remotePeer is a peer connected to another instance of the cluster.
+type remotePeer struct {
+	node  string
+	since string
+}
+
+// cluster tracks the instances of the cluster.
+type cluster struct {
+	node     string
+	broker   Broker
+	interval time.Duration
+
+	mu sync.Mutex
+	// Last heartbeat of the other instances by node ID.
+	nodes map[string]time.Time
+
+	// stop stops the heartbeat, which closes done once stopped.
+	stop chan struct{}
+	done chan struct{}
+}
+
+// EnableCluster relays the room events to the other instances through the
+// broker. Instances must share the store, and a peer must reach the same
+// instance for logging in and connecting. Instances announce themselves
+// every interval, the rooms are owned by the live instances using
+// rendezvous hashing. It must be called before any room is started.
+func (h *Hub) EnableCluster(b Broker, interval time.Duration) error {
+	if interval <= 0 {
+		return errors.New("invalid cluster heartbeat interval")
+	}
+	node, err := GenerateGUID(12)
+	if err != nil {
+		return err
+	}
+	h.cluster = &cluster{
+		node:     node,
+		broker:   b,
+		interval: interval,
+		nodes:    make(map[string]time.Time),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if err := b.Subscribe(h.handleClusterEvent); err != nil {
+		h.cluster = nil
+		return err
+	}
+	go h.heartbeat()
+	h.log.Info("joined the cluster", "node", node)
+	return nil
+}
+
+// LeaveCluster stops the heartbeat, notifies the other instances that this
+// one is leaving and closes the broker. It must be called once.
+func (h *Hub) LeaveCluster() error {
+	if h.cluster == nil {
+		return nil
+	}
+	close(h.cluster.stop)
+	<-h.cluster.done
+	h.publish(clusterEvent{Type: evNodeLeave})
+	return h.cluster.broker.Close()
+}
+
+// heartbeat announces the instance and forgets the silent ones, until the
+// instance leaves the cluster.
+func (h *Hub) heartbeat() {
+	c := h.cluster
+	defer close(c.done)
+	t := time.NewTicker(c.interval)
+	defer t.Stop()
+	for {
+		h.publish(clusterEvent{Type: evNodeAlive})
+
+		var (
+			gone     []string
+			deadline = time.Now().Add(-3 * c.interval)
+		)
+		c.mu.Lock()
+		for node, seen := range c.nodes {
+			if seen.Before(deadline) {
+				delete(c.nodes, node)
+				gone = append(gone, node)
+			}
+		}
+		c.mu.Unlock()
+		for _, node := range gone {
+			h.log.Warn("lost cluster node", "node", node)
+			h.dropNode(node)
+		}
+
+		select {
+		case <-t.C:
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// publish relays an event to the other instances.
+func (h *Hub) publish(ev clusterEvent) {
+	if h.cluster == nil {
+		return
+	}
+	ev.Node = h.cluster.node
+	b, err := json.Marshal(ev)
+	if err != nil {
+		h.log.Error("error encoding cluster event", "err", err)
+		return
+	}
+	if err := h.cluster.broker.Publish(b); err != nil {
+		h.log.Error("error publishing cluster event", "err", err)
+	}
+}
+
+// handleClusterEvent processes an event received from the broker.
+func (h *Hub) handleClusterEvent(b []byte) {
+	var ev clusterEvent
+	if err := json.Unmarshal(b, &ev); err != nil {
+		h.log.Error("error decoding cluster event", "err", err)
+		return
+	}
+	c := h.cluster
+	if ev.Node == c.node {
+		return
+	}
+
+	switch ev.Type {
+	case evNodeAlive:
+		c.mu.Lock()
+		_, known := c.nodes[ev.Node]
+		c.nodes[ev.Node] = time.Now()
+		c.mu.Unlock()
+		if !known {
+			h.log.Info("found cluster node", "node", ev.Node)
+		}
+		return
+
+	case evNodeLeave:
+		c.mu.Lock()
+		delete(c.nodes, ev.Node)
+		c.mu.Unlock()
+		h.log.Info("cluster node left", "node", ev.Node)
+		h.dropNode(ev.Node)
+		return
+	}
+
+	// Room events only matter to the instances running the room.
+	h.mut.RLock()
+	r := h.rooms[ev.Room]
+	h.mut.RUnlock()
+	if r != nil {
+		r.queueRemote(ev)
+	}
+}
+
+// dropNode removes the peers of a node from all the rooms.
+func (h *Hub) dropNode(node string) {
+	for _, r := range h.getRooms() {
+		r.queueRemote(clusterEvent{Type: evNodeLeave, Node: node})
+	}
+}
+
+// ownsRoom returns true if this instance owns the room. The owner is
+// the live instance with the highest hash of its node ID and the room ID.
+// Standalone hubs own all their rooms.
+func (h *Hub) ownsRoom(id string) bool {
+	c := h.cluster
+	if c == nil {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	score := nodeScore(c.node, id)
+	for node := range c.nodes {
+		if s := nodeScore(node, id); s > score || (s == score && node > c.node) {
+			return false
+		}
+	}
+	return true
+}
+
+// nodeScore returns the rendezvous hash of a node for a room.
+func nodeScore(node, room string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(node))
+	h.Write([]byte{0})
+	h.Write([]byte(room))
+	return h.Sum64()
+}
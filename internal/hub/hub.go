@@ -1,13 +1,20 @@
 package hub
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
-	"log"
+	"fmt"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/knadh/niltalk/internal/logging"
 	"github.com/knadh/niltalk/internal/notify"
+	"github.com/knadh/niltalk/store"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // Types of messages sent to peers.
@@ -22,8 +29,15 @@ const (
 	TypePeerJoin        = "peer.join"
 	TypePeerLeave       = "peer.leave"
 	TypePeerRateLimited = "peer.ratelimited"
+	TypePeerKick        = "peer.kick"
+	TypePeerBan         = "peer.ban"
+	TypePeerUnban       = "peer.unban"
+	TypePeerMute        = "peer.mute"
+	TypePeerUnmute      = "peer.unmute"
+	TypeRoomOwner       = "room.owner"
 	TypeRoomDispose     = "room.dispose"
 	TypeRoomFull        = "room.full"
+	TypeServerShutdown  = "server.shutdown"
 	TypeMustLogin       = "room.full"
 	TypeNotice          = "notice"
 	// TypeHandle          = "handle"
@@ -35,6 +49,16 @@ const (
 	// TypeChallengeRes    = "challenge.res"
 )
 
+// Store keys of the persisted rooms.
+const (
+	// keyRoom is the key format of a persisted room record.
+	keyRoom = "ROOM:%s"
+	// keyRoomID reserves a room ID across the instances sharing the store.
+	keyRoomID = "ROOMID:%s"
+	// keyRoomIndex is the key of the list of persisted room IDs.
+	keyRoomIndex = "ROOMS"
+)
+
 // Config represents the app configuration.
 type Config struct {
 	Address string `koanf:"address"`
@@ -53,6 +77,7 @@ type Config struct {
 	PeerHandleFormat  string        `koanf:"peer_handle_format"`
 	RoomTimeout       time.Duration `koanf:"room_timeout"`
 	RoomAge           time.Duration `koanf:"room_age"`
+	MaxRoomLifetime   time.Duration `koanf:"max_room_lifetime"`
 	SessionCookie     string        `koanf:"session_cookie"`
 	Storage           string        `koanf:"storage"`
 
@@ -69,6 +94,11 @@ type PredefinedRoom struct {
 	Growl    notify.Options   `koanf:"growl"`
 	Users    []PredefinedUser `koanf:"users"`
 	Motd     string           `koanf:"motd"`
+	// MessageTTL is the longest lifetime of the messages, 0 if they
+	// do not expire.
+	MessageTTL time.Duration `koanf:"message_ttl"`
+	// PersistBacklog keeps the message backlog of the room in the store.
+	PersistBacklog bool `koanf:"persist_backlog"`
 }
 
 // PredefinedUser are static users declared in the configuration file.
@@ -76,67 +106,279 @@ type PredefinedUser struct {
 	Name     string `koanf:"name"`
 	Password string `koanf:"password"`
 	Growl    bool   `koanf:"growl"`
+	// Owner users administrate the room, they must have a password.
+	Owner bool `koanf:"owner"`
 }
 
 // Hub acts as the controller and container for all chat rooms.
 type Hub struct {
 	rooms map[string]*Room
 
-	cfg *Config
-	mut sync.RWMutex
-	log *log.Logger
+	// cfg is replaced when the configuration is reloaded, read it with Config.
+	cfg    *Config
+	cfgMut sync.RWMutex
+
+	store store.Store
+	mut   sync.RWMutex
+	log   *logging.Logger
+
+	// pending is the number of ad-hoc rooms being created, counted
+	// against max_rooms along with the active ones.
+	pending int
+	// reserved holds the IDs generated for the rooms being created
+	// until they are added to rooms.
+	reserved map[string]bool
+
+	// cluster is nil unless the hub runs in cluster mode.
+	cluster *cluster
+
+	// onDispose are called with the ID of each disposed of room.
+	onDispose []func(roomID string)
 }
 
-// NewHub returns a new instance of Hub.
-func NewHub(cfg *Config, l *log.Logger) *Hub {
-	return &Hub{
-		rooms: make(map[string]*Room),
+// NewHub returns a new instance of Hub. The ad-hoc rooms persisted
+// in the store are restored by LoadRooms.
+func NewHub(cfg *Config, s store.Store, l *logging.Logger) *Hub {
+	h := &Hub{
+		rooms:    make(map[string]*Room),
+		reserved: make(map[string]bool),
 
-		cfg: cfg,
-		log: l,
+		cfg:   cfg,
+		store: s,
+		log:   l,
 	}
+	return h
+}
+
+// Config returns the current configuration of the hub.
+// It must not be modified.
+func (h *Hub) Config() *Config {
+	h.cfgMut.RLock()
+	defer h.cfgMut.RUnlock()
+	return h.cfg
+}
+
+// SetConfig replaces the configuration of the hub. Running rooms and
+// connected peers pick up the new settings the next time they use them.
+func (h *Hub) SetConfig(cfg *Config) {
+	h.cfgMut.Lock()
+	h.cfg = cfg
+	h.cfgMut.Unlock()
 }
 
 // AddRoom creates a new room in the store, adds it to the hub, and
 // returns the room (which has to be .Run() on a goroutine then).
-func (h *Hub) AddRoom(name string) (*Room, error) {
+// An empty password creates a room anyone can join. opt sets its lifecycle,
+// it must have been validated. It also returns the token the creator
+// claims the ownership of the room with.
+func (h *Hub) AddRoom(name, password string, opt RoomOptions) (*Room, string, error) {
+	if err := h.reserveRoom(); err != nil {
+		return nil, "", err
+	}
+	defer h.releaseRoom()
 
-	id, err := h.generateRoomID(h.cfg.RoomIDLen, 5)
+	pwdHash, err := hashPassword(password)
 	if err != nil {
-		return nil, err
+		h.log.Error("error hashing room password", "err", err)
+		return nil, "", errors.New("error hashing room password")
+	}
+
+	id, err := h.generateRoomID(h.Config().RoomIDLen, 5)
+	if err != nil {
+		return nil, "", err
+	}
+	defer h.releaseRoomID(id)
+
+	ownerToken, err := GenerateGUID(32)
+	if err != nil {
+		h.log.Error("error generating owner token", "err", err)
+		return nil, "", errors.New("error generating owner token")
 	}
 
 	// Initialize the room.
-	return h.initRoom(id, name, false), nil
+	r := NewRoom(id, name, h, false)
+	r.Password = pwdHash
+	r.ownerToken = hashToken(ownerToken)
+	r.idleTimeout = opt.IdleTimeout
+	r.destroyAt = opt.ExpiresAt
+	r.burnAfter = opt.BurnAfter
+	r.messageTTL = opt.MessageTTL
+	r.expiresAt = r.deadline()
+	if _, err := h.initRoom(r); err != nil {
+		return nil, "", err
+	}
+	if err := h.saveRoom(r); err != nil {
+		h.log.Error("error saving room to the store", "room", logging.ID(id), "err", err)
+	}
+	return r, ownerToken, nil
 }
 
-// AddPredefinedRoom creates a predefined room in the store, adds it to the hub.
-// If it already exists, no error is returned.
-func (h *Hub) AddPredefinedRoom(ID, name string) (*Room, error) {
+// reserveRoom counts a room being created against max_rooms, so that
+// concurrent creations can not exceed it. It must be released with
+// releaseRoom once the room is added to the hub or its creation failed.
+func (h *Hub) reserveRoom() error {
+	max := h.Config().MaxRooms
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	if max > 0 && len(h.rooms)+h.pending >= max {
+		metricRoomsRefused.Inc()
+		return ErrMaxRooms
+	}
+	h.pending++
+	return nil
+}
+
+func (h *Hub) releaseRoom() {
+	h.mut.Lock()
+	h.pending--
+	h.mut.Unlock()
+}
+
+// AddPredefinedRoom creates a predefined room and adds it to the hub.
+// It returns ErrRoomExists if a room with the same ID is active.
+func (h *Hub) AddPredefinedRoom(ID, name, password string) (*Room, error) {
+	pwdHash, err := hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
 
 	// Initialize the room.
-	return h.initRoom(ID, name, true), nil
+	r := NewRoom(ID, name, h, true)
+	r.Password = pwdHash
+	return h.initRoom(r)
 }
 
-// GetRoom retrives an active room from the hub.
+// GetRoom retrives an active room from the hub. In cluster mode,
+// the rooms created by other instances are loaded from the store.
 func (h *Hub) GetRoom(id string) *Room {
 	h.mut.Lock()
 	r, _ := h.rooms[id]
 	h.mut.Unlock()
+	if r == nil && h.cluster != nil {
+		r = h.loadRoom(id)
+	}
+	return r
+}
+
+// RoomExists returns true if a room is running on this instance or, in
+// cluster mode, is stored, without loading it.
+func (h *Hub) RoomExists(id string) (bool, error) {
+	h.mut.Lock()
+	_, ok := h.rooms[id]
+	h.mut.Unlock()
+	if ok || h.cluster == nil {
+		return ok, nil
+	}
+	rec, err := h.getRoomRecord(id)
+	return rec != nil, err
+}
+
+// loadRoom restores a room from the store if it is not running yet,
+// and fetches its peers from the other instances.
+func (h *Hub) loadRoom(id string) *Room {
+	rec, err := h.getRoomRecord(id)
+	if err != nil || rec == nil {
+		return nil
+	}
+
+	h.mut.Lock()
+	if r, ok := h.rooms[id]; ok {
+		h.mut.Unlock()
+		return r
+	}
+	r := h.roomFromRecord(*rec)
+	h.rooms[id] = r
+	metricRooms.Set(int64(len(h.rooms)))
+	go r.run()
+	h.mut.Unlock()
+
+	h.publish(clusterEvent{Type: evRoomSync, Room: id})
 	return r
 }
 
-// initRoom initializes a room on the Hub.
-func (h *Hub) initRoom(id, name string, predefined bool) *Room {
-	r := NewRoom(id, name, h, predefined)
+// initRoom registers a room on the Hub and starts its event loop.
+// In cluster mode, the other instances are asked for its peers.
+// An active room is never replaced, ErrRoomExists is returned instead.
+func (h *Hub) initRoom(r *Room) (*Room, error) {
+	id := r.ID
+	predefined := r.Predefined
 	h.mut.Lock()
 	defer h.mut.Unlock()
+	if _, ok := h.rooms[id]; ok {
+		return nil, ErrRoomExists
+	}
 	if predefined {
-		r.motd = h.cfg.Rooms[id].Motd
+		rc := h.Config().Rooms[id]
+		r.motd = rc.Motd
+		r.messageTTL = rc.MessageTTL
+		r.persistBacklog = rc.PersistBacklog
+		if r.persistBacklog {
+			if err := r.loadBacklog(); err != nil {
+				h.log.Error("error loading the room backlog", "room", logging.ID(id), "err", err)
+			}
+		}
 	}
 	h.rooms[id] = r
+	metricRooms.Set(int64(len(h.rooms)))
 	go r.run()
-	return r
+	h.publish(clusterEvent{Type: evRoomSync, Room: id})
+	return r, nil
+}
+
+// Shutdown stops all the rooms, notifying their peers that the server is
+// restarting, and leaves the cluster. Rooms are kept in the store.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	rooms := h.getRooms()
+	stopped := make([]<-chan struct{}, 0, len(rooms))
+	for _, r := range rooms {
+		stopped = append(stopped, r.shutdown())
+	}
+	for _, c := range stopped {
+		select {
+		case <-c:
+		case <-ctx.Done():
+			h.LeaveCluster()
+			return ctx.Err()
+		}
+	}
+	return h.LeaveCluster()
+}
+
+// RoomInfo describes an active room to the operators.
+type RoomInfo struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	Predefined   bool      `json:"predefined"`
+	Peers        int       `json:"peers"`
+	RemotePeers  int       `json:"remote_peers"`
+	Owner        string    `json:"owner"`
+	Motd         string    `json:"motd"`
+	CreatedAt    time.Time `json:"created_at"`
+	LastActivity time.Time `json:"last_activity"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// Rooms returns the state of the active rooms, sorted by creation date.
+func (h *Hub) Rooms() []RoomInfo {
+	rooms := h.getRooms()
+	out := make([]RoomInfo, 0, len(rooms))
+	for _, r := range rooms {
+		if info, ok := r.Info(); ok {
+			out = append(out, info)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].CreatedAt.Before(out[j].CreatedAt)
+	})
+	return out
+}
+
+// BroadcastNotice broadcasts a notice of the operators to the peers
+// of all the active rooms.
+func (h *Hub) BroadcastNotice(msg string) {
+	for _, r := range h.getRooms() {
+		go r.BroadcastNotice(msg)
+	}
 }
 
 // getRooms returns the list of active rooms.
@@ -150,41 +392,274 @@ func (h *Hub) getRooms() []*Room {
 	return out
 }
 
-// removeRoom removes a room from the hub and the store.
-func (h *Hub) removeRoom(id string) error {
+// OnDispose registers a function called with the ID of each room disposed
+// of, to release its resources. It must be called before LoadRooms.
+func (h *Hub) OnDispose(fn func(roomID string)) {
+	h.onDispose = append(h.onDispose, fn)
+}
+
+// removeRoom removes a room from the hub, and from the store if purge is set.
+func (h *Hub) removeRoom(id string, purge bool) error {
 	h.mut.Lock()
 	defer h.mut.Unlock()
 	delete(h.rooms, id)
-	return nil
+	metricRooms.Set(int64(len(h.rooms)))
+	if !purge {
+		return nil
+	}
+
+	ids, err := h.getRoomIndex()
+	if err != nil {
+		return err
+	}
+	for i, x := range ids {
+		if x == id {
+			ids = append(ids[:i], ids[i+1:]...)
+			if err := h.setRoomIndex(ids); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	return h.store.Delete(fmt.Sprintf(keyRoom, id))
+}
+
+// saveRoom writes the room record to the store, expiring with the room,
+// and adds it to the index of persisted rooms.
+func (h *Hub) saveRoom(r *Room) error {
+	b, err := json.Marshal(r.record())
+	if err != nil {
+		return err
+	}
+	if err := h.store.SetWithTTL(fmt.Sprintf(keyRoom, r.ID), b, time.Until(r.expiresAt)); err != nil {
+		return err
+	}
+
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	ids, err := h.getRoomIndex()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if id == r.ID {
+			return nil
+		}
+	}
+	return h.setRoomIndex(append(ids, r.ID))
+}
+
+// LoadRooms restores the persisted rooms that have not expired yet,
+// and removes the others from the store. It must be called once the
+// cluster is enabled and the dispose hooks are registered, which the
+// rooms use once started.
+func (h *Hub) LoadRooms() {
+	ids, err := h.getRoomIndex()
+	if err != nil {
+		h.log.Error("error reading rooms from the store", "err", err)
+		return
+	}
+
+	var (
+		active   = make([]string, 0, len(ids))
+		restored = 0
+	)
+	for _, id := range ids {
+		rec, err := h.getRoomRecord(id)
+		if err != nil {
+			// Keep the room in the index to retry on the next start.
+			h.log.Error("error reading room", "room", logging.ID(id), "err", err)
+			active = append(active, id)
+			continue
+		}
+		if rec == nil {
+			continue
+		}
+		if _, err := h.initRoom(h.roomFromRecord(*rec)); err != nil {
+			// A duplicate entry of the index.
+			continue
+		}
+		active = append(active, id)
+		restored++
+	}
+	if restored > 0 {
+		h.log.Info("restored rooms from the store", "count", restored)
+	}
+	if len(active) != len(ids) {
+		if err := h.setRoomIndex(active); err != nil {
+			h.log.Error("error writing rooms to the store", "err", err)
+		}
+	}
 }
 
-// generateRoomID generates a random room ID while checking the store for
-// uniqueness up to numTries times.
+// getRoomRecord reads a room record from the store. It returns nil
+// if the room does not exist or has expired.
+func (h *Hub) getRoomRecord(id string) (*store.Room, error) {
+	key := fmt.Sprintf(keyRoom, id)
+	b, err := h.store.Get(key)
+	if err == store.ErrNotFound || (err == nil && len(b) == 0) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rec store.Room
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return nil, err
+	}
+	if !rec.ExpiresAt.IsZero() && rec.ExpiresAt.Before(time.Now()) {
+		h.store.Delete(key)
+		return nil, nil
+	}
+	return &rec, nil
+}
+
+// roomFromRecord returns a room restored from its record.
+func (h *Hub) roomFromRecord(rec store.Room) *Room {
+	r := NewRoom(rec.ID, rec.Name, h, false)
+	r.Password = rec.Password
+	r.CreatedAt = rec.CreatedAt
+	r.expiresAt = rec.ExpiresAt
+	r.idleTimeout = rec.IdleTimeout
+	r.destroyAt = rec.DestroyAt
+	r.burnAfter = rec.BurnAfter
+	r.burnAt = rec.BurnAt
+	r.messageTTL = rec.MessageTTL
+	r.owner = rec.Owner
+	r.ownerToken = rec.OwnerToken
+	r.banned = toSet(rec.Banned)
+	r.muted = toSet(rec.Muted)
+	return r
+}
+
+// getRoomIndex returns the IDs of the rooms persisted in the store.
+func (h *Hub) getRoomIndex() ([]string, error) {
+	var ids []string
+	b, err := h.store.Get(keyRoomIndex)
+	if err == store.ErrNotFound || (err == nil && len(b) == 0) {
+		// The index does not exist yet.
+		return ids, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &ids)
+	return ids, err
+}
+
+// setRoomIndex writes the IDs of the rooms persisted in the store.
+func (h *Hub) setRoomIndex(ids []string) error {
+	b, err := json.Marshal(ids)
+	if err != nil {
+		return err
+	}
+	return h.store.Set(keyRoomIndex, b)
+}
+
+// generateRoomID generates a random room ID that is not used by an active
+// room, a room being created, or a room persisted in the store, up to
+// numTries times. In cluster mode, the ID is also reserved in the store
+// against the other instances. The ID is reserved until releaseRoomID.
 func (h *Hub) generateRoomID(length, numTries int) (string, error) {
 	for i := 0; i < numTries; i++ {
 		id, err := GenerateGUID(length)
 		if err != nil {
-			h.log.Printf("error generating room ID: %v", err)
+			h.log.Error("error generating room ID", "err", err)
 			return "", errors.New("error generating room ID")
 		}
 
+		h.mut.Lock()
 		_, exists := h.rooms[id]
+		exists = exists || h.reserved[id]
 		if !exists {
+			h.reserved[id] = true
+		}
+		h.mut.Unlock()
+		if exists {
+			continue
+		}
+
+		// The store is checked outside of the lock, the ID is reserved
+		// locally in the meantime.
+		ok, err := h.claimRoomID(id)
+		if err != nil {
+			h.releaseRoomID(id)
+			h.log.Error("error reserving room ID", "room", logging.ID(id), "err", err)
+			return "", errors.New("error generating room ID")
+		}
+		if ok {
 			return id, nil
 		}
+		h.releaseRoomID(id)
 	}
 	return "", errors.New("unable to generate unique room ID")
 }
 
+// claimRoomID returns false if a room with the ID is persisted in the store
+// or, in cluster mode, was reserved by another instance.
+func (h *Hub) claimRoomID(id string) (bool, error) {
+	rec, err := h.getRoomRecord(id)
+	if err != nil {
+		return false, err
+	}
+	if rec != nil {
+		return false, nil
+	}
+
+	res, ok := h.store.(store.Reserver)
+	if !ok || h.cluster == nil {
+		return true, nil
+	}
+	return res.Reserve(fmt.Sprintf(keyRoomID, id), []byte{1}, h.Config().RoomAge)
+}
+
+// releaseRoomID removes the local reservation of a room ID.
+func (h *Hub) releaseRoomID(id string) {
+	h.mut.Lock()
+	delete(h.reserved, id)
+	h.mut.Unlock()
+}
+
+// hashPassword returns the bcrypt hash of a password,
+// or nil if the password is empty.
+func hashPassword(password string) ([]byte, error) {
+	if password == "" {
+		return nil, nil
+	}
+	return bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+}
+
+// hashToken returns the SHA-256 hash of a token.
+func hashToken(token string) []byte {
+	h := sha256.Sum256([]byte(token))
+	return h[:]
+}
+
 // GenerateGUID generates a cryptographically random, alphanumeric string of length n.
+// Each character is uniformly distributed, carrying log2(62) bits of entropy.
 func GenerateGUID(n int) (string, error) {
 	const dictionary = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
-	var bytes = make([]byte, n)
-	if _, err := rand.Read(bytes); err != nil {
-		return "", err
-	}
-	for k, v := range bytes {
-		bytes[k] = dictionary[v%byte(len(dictionary))]
+	// Random bytes beyond the largest multiple of the dictionary length
+	// are discarded, as they would favor its first characters.
+	const limit = 256 - 256%len(dictionary)
+
+	var (
+		out = make([]byte, 0, n)
+		buf = make([]byte, n+n/4+1)
+	)
+	for len(out) < n {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		for _, v := range buf {
+			if int(v) >= limit {
+				continue
+			}
+			out = append(out, dictionary[int(v)%len(dictionary)])
+			if len(out) == n {
+				break
+			}
+		}
 	}
-	return string(bytes), nil
+	return string(out), nil
 }
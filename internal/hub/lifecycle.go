@@ -0,0 +1,188 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// minRoomLifetime is the shortest lifetime a room can be created with.
+const minRoomLifetime = time.Minute
+
+// expiryWarnings are the delays before the expiry of a room at which its
+// peers are warned, longest first.
+var expiryWarnings = []time.Duration{time.Hour, time.Minute * 10, time.Minute}
+
+// RoomOptions are the lifecycle settings of an ad-hoc room. The room is
+// disposed of at the earliest of its expiries.
+type RoomOptions struct {
+	// IdleTimeout disposes of the room after a period without activity,
+	// room_age when 0.
+	IdleTimeout time.Duration
+	// ExpiresAt disposes of the room at a given time, if set.
+	ExpiresAt time.Time
+	// BurnAfter disposes of the room after a period since the first peer
+	// joined it, if set.
+	BurnAfter time.Duration
+	// MessageTTL is the longest lifetime of the messages, 0 if they
+	// do not expire.
+	MessageTTL time.Duration
+}
+
+// Validate checks the options against the limits of the configuration.
+func (o RoomOptions) Validate(cfg *Config) error {
+	if o.IdleTimeout != 0 && (o.IdleTimeout < minRoomLifetime || o.IdleTimeout > cfg.RoomAge) {
+		return fmt.Errorf("idle timeout should be between %v and %v", minRoomLifetime, cfg.RoomAge)
+	}
+
+	if !o.ExpiresAt.IsZero() {
+		left := time.Until(o.ExpiresAt)
+		if left < minRoomLifetime {
+			return errors.New("expiry should be in the future")
+		}
+		if cfg.MaxRoomLifetime > 0 && left > cfg.MaxRoomLifetime {
+			return fmt.Errorf("expiry should be within %v", cfg.MaxRoomLifetime)
+		}
+	}
+
+	if o.MessageTTL < 0 {
+		return errors.New("message lifetime should be positive")
+	}
+
+	if o.BurnAfter != 0 {
+		if o.BurnAfter < minRoomLifetime {
+			return errors.New("burn after should be positive")
+		}
+		if cfg.MaxRoomLifetime > 0 && o.BurnAfter > cfg.MaxRoomLifetime {
+			return fmt.Errorf("burn after should be within %v", cfg.MaxRoomLifetime)
+		}
+	}
+	return nil
+}
+
+// deadline returns when the room is disposed of: the earliest of its idle,
+// absolute and burn expiries.
+func (r *Room) deadline() time.Time {
+	idle := r.idleTimeout
+	if idle == 0 {
+		idle = r.hub.Config().RoomAge
+	}
+	d := r.lastActivity.Add(idle)
+	if !r.destroyAt.IsZero() && r.destroyAt.Before(d) {
+		d = r.destroyAt
+	}
+	if !r.burnAt.IsZero() && r.burnAt.Before(d) {
+		d = r.burnAt
+	}
+	return d
+}
+
+// checkExpiry warns the peers of the upcoming expiry of the room, and
+// returns true once the room expired.
+func (r *Room) checkExpiry(now time.Time) bool {
+	d := r.deadline()
+	left := d.Sub(now)
+	if left <= 0 {
+		return true
+	}
+
+	if !d.Equal(r.warnDeadline) {
+		// The deadline moved, the warnings start over, skipping the ones
+		// that are already due so that peers are not warned of an expiry
+		// that activity keeps pushing back.
+		r.warnDeadline, r.warned = d, 0
+		for r.warned < len(expiryWarnings) && left <= expiryWarnings[r.warned] {
+			r.warned++
+		}
+		return false
+	}
+
+	due := false
+	for r.warned < len(expiryWarnings) && left <= expiryWarnings[r.warned] {
+		due = true
+		r.warned++
+	}
+	if due {
+		msg := fmt.Sprintf("This room will be destroyed in %s.", formatLeft(left))
+		for p := range r.peers {
+			r.sendNotice(p, msg)
+		}
+	}
+	return false
+}
+
+// nextExpiryCheck returns the delay until the next warning or the expiry
+// of the room.
+func (r *Room) nextExpiryCheck(now time.Time) time.Duration {
+	d := r.deadline()
+	next := d
+	if d.Equal(r.warnDeadline) && r.warned < len(expiryWarnings) {
+		next = d.Add(-expiryWarnings[r.warned])
+	}
+	if wait := next.Sub(now); wait > 0 {
+		return wait
+	}
+	return time.Millisecond
+}
+
+// burn starts the burn countdown of the room when its first peer joins.
+// It returns true if it started.
+func (r *Room) burn() bool {
+	if r.burnAfter == 0 || !r.burnAt.IsZero() {
+		return false
+	}
+	r.burnAt = time.Now().Add(r.burnAfter)
+	return true
+}
+
+func formatLeft(d time.Duration) string {
+	d = d.Round(time.Minute)
+	switch {
+	case d >= time.Hour:
+		return plural(int(d/time.Hour), "hour")
+	case d >= time.Minute:
+		return plural(int(d/time.Minute), "minute")
+	}
+	return "less than a minute"
+}
+
+func plural(n int, unit string) string {
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
+
+// stampExpiry sets the expiry of a message from the TTL asked by its sender
+// and the message TTL of the room, the shortest one applying. It returns
+// the expiry, zero if the message does not expire.
+func (r *Room) stampExpiry(m *SealedMsg) time.Time {
+	r.mut.RLock()
+	ttl := r.messageTTL
+	r.mut.RUnlock()
+	if m.TTL > 0 {
+		if d := time.Duration(m.TTL) * time.Second; ttl == 0 || d < ttl {
+			ttl = d
+		}
+	}
+
+	m.TTL, m.ExpiresAt = 0, ""
+	if ttl == 0 {
+		return time.Time{}
+	}
+	exp := time.Now().Add(ttl)
+	m.ExpiresAt = exp.UTC().Format(JSDateFormat)
+	return exp
+}
+
+// expiry returns the expiry stamped on a message, zero if it does not expire.
+func (m SealedMsg) expiry() time.Time {
+	if m.ExpiresAt == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(JSDateFormat, m.ExpiresAt)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
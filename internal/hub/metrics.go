@@ -0,0 +1,14 @@
+package hub
+
+import "github.com/knadh/niltalk/internal/metrics"
+
+// Metrics of the rooms. They never include message contents or public keys.
+var (
+	metricRooms          = metrics.NewGauge("niltalk_rooms", "Number of active rooms.")
+	metricRoomsRefused   = metrics.NewCounter("niltalk_rooms_refused_total", "Number of room creations refused by max_rooms.")
+	metricPeers          = metrics.NewGauge("niltalk_peers", "Number of connected peers.")
+	metricSealed         = metrics.NewCounter("niltalk_messages_total", "Number of messages routed by the rooms.", "type", "sealed")
+	metricUnsealed       = metrics.NewCounter("niltalk_messages_total", "Number of messages routed by the rooms.", "type", "unsealed")
+	metricRateLimited    = metrics.NewCounter("niltalk_ratelimited_messages_total", "Number of messages dropped by the peer rate limiter.")
+	metricRateLimitKicks = metrics.NewCounter("niltalk_ratelimit_kicks_total", "Number of peers disconnected for exceeding the message rate.")
+)
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/knadh/niltalk/internal/logging"
 	"golang.org/x/time/rate"
 )
 
@@ -18,7 +19,9 @@ type Peer struct {
 	ws *websocket.Conn
 
 	// Channel for outbound messages.
-	dataQ chan []byte
+	dataQ chan outMsg
+	// Reason of the close frame sent once dataQ is closed.
+	closeReason string
 
 	// Peer's room.
 	room *Room
@@ -26,6 +29,13 @@ type Peer struct {
 	lastMessage time.Time
 }
 
+// outMsg is a message queued to a peer. It is dropped if it expires
+// before it is written.
+type outMsg struct {
+	data      []byte
+	expiresAt time.Time
+}
+
 type peerInfo struct {
 	ID     string `json:"id"`
 	Handle string `json:"handle"`
@@ -38,7 +48,7 @@ func newPeer(secret, spubKey string, publicKey [32]byte, since time.Time, room *
 		PublicKey:  spubKey,
 		BPublicKey: publicKey,
 		Since:      since,
-		dataQ:      make(chan []byte, 100),
+		dataQ:      make(chan outMsg, 100),
 		room:       room,
 	}
 }
@@ -51,9 +61,18 @@ func (p *Peer) Connect(ws *websocket.Conn) {
 // RunListener is a blocking function that reads incoming messages from a peer's
 // WS connection until its dropped or there's an error. This should be invoked
 // as a goroutine.
+//
+// Messages beyond the configured rate are dropped, the peer is warned on
+// the first one, and kicked if it keeps sending too many messages.
+// The rate follows the configuration when it is reloaded.
 func (p *Peer) RunListener() {
-	rl := rate.NewLimiter(rate.Every(time.Second), 3)
-	p.ws.SetReadLimit(int64(p.room.hub.cfg.MaxMessageLen))
+	var (
+		cfg      = p.room.hub.Config()
+		rl       = newRateLimiter(cfg.RateLimitMessages, cfg.RateLimitInterval)
+		dropped  int
+		lastDrop time.Time
+	)
+	p.ws.SetReadLimit(int64(cfg.MaxMessageLen))
 	for {
 		_, m, err := p.ws.ReadMessage()
 		if err != nil {
@@ -62,8 +81,33 @@ func (p *Peer) RunListener() {
 		if len(m) < 1 {
 			continue
 		}
+		if c := p.room.hub.Config(); c != cfg {
+			cfg = c
+			rl = newRateLimiter(cfg.RateLimitMessages, cfg.RateLimitInterval)
+		}
 		if rl.Allow() {
 			p.processMessage(m)
+			continue
+		}
+
+		// Forget about past excesses after a quiet interval.
+		if time.Since(lastDrop) > rl.interval {
+			dropped = 0
+		}
+		lastDrop = time.Now()
+		dropped++
+		metricRateLimited.Inc()
+		if dropped == 1 {
+			p.room.hub.log.Warn("peer exceeded the message rate", "room", logging.ID(p.room.ID), "peer", logging.ID(p.PublicKey))
+			p.room.queueOp(func() {
+				p.room.sendNotice(p, "You are sending messages too fast, slow down or you will be disconnected.")
+			})
+		} else if dropped > rl.burst {
+			p.room.hub.log.Warn("peer kicked for exceeding the message rate", "room", logging.ID(p.room.ID), "peer", logging.ID(p.PublicKey))
+			metricRateLimitKicks.Inc()
+			p.writeWSControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, TypePeerRateLimited))
+			break
 		}
 	}
 
@@ -72,6 +116,27 @@ func (p *Peer) RunListener() {
 	p.room.queuePeerReq(TypePeerLeave, p)
 }
 
+// rateLimiter is a token bucket of burst messages refilled every interval.
+type rateLimiter struct {
+	*rate.Limiter
+	burst    int
+	interval time.Duration
+}
+
+// newRateLimiter returns a limiter allowing bursts of n messages, refilled
+// over interval. If either is not set, it allows one message per second
+// in bursts of 3.
+func newRateLimiter(n int, interval time.Duration) rateLimiter {
+	if n <= 0 || interval <= 0 {
+		n, interval = 3, 3*time.Second
+	}
+	return rateLimiter{
+		Limiter:  rate.NewLimiter(rate.Every(interval/time.Duration(n)), n),
+		burst:    n,
+		interval: interval,
+	}
+}
+
 // RunWriter is a blocking function that writes messages in a peer's queue to the
 // peer's WS connection. This should be invoked as a goroutine.
 func (p *Peer) RunWriter() {
@@ -81,10 +146,17 @@ func (p *Peer) RunWriter() {
 		// Wait for outgoing message to appear in the channel.
 		case message, ok := <-p.dataQ:
 			if !ok {
-				p.writeWSData(websocket.CloseMessage, []byte{})
+				var payload []byte
+				if p.closeReason != "" {
+					payload = websocket.FormatCloseMessage(websocket.CloseNormalClosure, p.closeReason)
+				}
+				p.writeWSData(websocket.CloseMessage, payload)
 				return
 			}
-			if err := p.writeWSData(websocket.TextMessage, message); err != nil {
+			if !message.expiresAt.IsZero() && !message.expiresAt.After(time.Now()) {
+				continue
+			}
+			if err := p.writeWSData(websocket.TextMessage, message.data); err != nil {
 				return
 			}
 		}
@@ -93,12 +165,18 @@ func (p *Peer) RunWriter() {
 
 // SendData queues a message to be written to the peer's WS.
 func (p *Peer) SendData(b []byte) {
-	p.dataQ <- b
+	p.dataQ <- outMsg{data: b}
+}
+
+// sendExpiring queues a message that is dropped if it expires before
+// it is written, unless exp is zero.
+func (p *Peer) sendExpiring(b []byte, exp time.Time) {
+	p.dataQ <- outMsg{data: b, expiresAt: exp}
 }
 
 // writeWSData writes the given payload to the peer's WS connection.
 func (p *Peer) writeWSData(msgType int, payload []byte) error {
-	p.ws.SetWriteDeadline(time.Now().Add(p.room.hub.cfg.WSTimeout))
+	p.ws.SetWriteDeadline(time.Now().Add(p.room.hub.Config().WSTimeout))
 	return p.ws.WriteMessage(msgType, payload)
 }
 
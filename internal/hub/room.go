@@ -12,7 +12,9 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/knadh/niltalk/internal/logging"
 	"github.com/knadh/niltalk/store"
+	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/crypto/nacl/box"
 )
 
@@ -29,6 +31,12 @@ type SealedMsg struct {
 	To    string      `json:"to"`
 	From  string      `json:"from"`
 	Nonce string      `json:"nonce"`
+
+	// TTL is the lifetime in seconds the sender asks for, capped by the
+	// message TTL of the room. ExpiresAt is set by the server from them,
+	// the message is then dropped once expired and deleted by the clients.
+	TTL       int    `json:"ttl,omitempty"`
+	ExpiresAt string `json:"expiresAt,omitempty"`
 }
 
 type roomPublicKeyMsg struct {
@@ -41,6 +49,11 @@ type motdMsg struct {
 	Msg  string `json:"message"`
 }
 
+type noticeMsg struct {
+	Type string `json:"type"`
+	Msg  string `json:"message"`
+}
+
 type peerMsg struct {
 	Type      string `json:"type"`
 	PublicKey string `json:"publicKey"`
@@ -50,6 +63,14 @@ type peerMsg struct {
 type peerListMsg struct {
 	Type  string    `json:"type"`
 	Peers []peerMsg `json:"peers"`
+	Owner string    `json:"owner"`
+}
+
+// forwardReq is a message to forward, sent by peer
+// unless it was relayed by the server.
+type forwardReq struct {
+	msg  SealedMsg
+	peer *Peer
 }
 
 // peerReq represents a peer request (join, leave etc.) that's processed
@@ -91,21 +112,69 @@ type Room struct {
 	Password        []byte
 	Predefined      bool
 	PredefinedUsers []PredefinedUser
+	CreatedAt       time.Time
 
 	hub *Hub
 
+	// mut guards the settings of predefined rooms, which are replaced
+	// when the configuration is reloaded: Password, PredefinedUsers,
+	// userPasswords, ownerHandles, growlHandler and motd.
+	mut sync.RWMutex
+
+	// bcrypt hashes of the predefined users passwords by handle.
+	userPasswords map[string][]byte
+	// Handles of the predefined users owning the room.
+	ownerHandles map[string]bool
+
+	// Public key of the peer administrating the room, and the hash
+	// of the token the creator of the room claims it with.
+	owner      string
+	ownerToken []byte
+
+	// Public keys of the banned and muted peers.
+	banned map[string]bool
+	muted  map[string]bool
+
 	lastActivity time.Time
 
+	// expiresAt is the expiry of the room record in the store.
+	expiresAt time.Time
+
+	// Lifecycle of ad-hoc rooms, see RoomOptions. burnAt is set when
+	// the first peer joins a room with burnAfter.
+	idleTimeout time.Duration
+	destroyAt   time.Time
+	burnAfter   time.Duration
+	burnAt      time.Time
+
+	// messageTTL is the longest lifetime of the messages, 0 if they do
+	// not expire. It is guarded by mut for predefined rooms.
+	messageTTL time.Duration
+
+	// Deadline the peers are being warned of, and the number of
+	// expiryWarnings sent for it.
+	warnDeadline time.Time
+	warned       int
+
 	// List of connected peers.
 	peers peerList
 
+	// Peers connected to the other instances of the cluster by public key.
+	remotePeers map[string]remotePeer
+	// Events relayed by the other instances of the cluster.
+	remoteQ chan clusterEvent
+
+	// Last sealed messages addressed to the room, replayed to connecting peers.
+	backlog        *backlog
+	persistBacklog bool
+
 	// Broadcast channel for messages.
 	broadcastUnsealed chan interface{}
 	broadcastSealed   chan []byte
-	forwardQ          chan SealedMsg
+	forwardQ          chan forwardReq
 
-	// GrowlHandler is an async callback fired when a peer notifies an offline predefined users.
-	GrowlHandler func(msg, handle, token string)
+	// growlHandler is an async callback fired when a peer notifies an offline predefined users.
+	growlHandler func(msg, handle, token string)
 	growlTokens  *tokenStore
 
 	// Peer related requests.
@@ -115,6 +184,11 @@ type Room struct {
 	// Dispose signal.
 	disposeSig chan bool
 
+	// Shutdown signal, and closed once the room is stopped.
+	stop     chan struct{}
+	stopOnce sync.Once
+	stopped  chan struct{}
+
 	op chan func()
 
 	timestamp time.Time
@@ -134,18 +208,29 @@ func NewRoom(id, name string, h *Hub, predefined bool) *Room {
 	if err != nil {
 		log.Fatalf("failed to generate random signature keys: %v", err)
 	}
+	now := time.Now()
 	return &Room{
 		ID:                id,
 		Name:              name,
 		Predefined:        predefined,
+		CreatedAt:         now,
+		lastActivity:      now,
+		expiresAt:         now.Add(h.Config().RoomAge),
 		hub:               h,
 		peers:             make(map[*Peer]bool, 100),
+		remotePeers:       make(map[string]remotePeer),
+		remoteQ:           make(chan clusterEvent, 100),
+		backlog:           newBacklog(h.Config().MaxCachedMessages),
 		broadcastUnsealed: make(chan interface{}, 100),
 		broadcastSealed:   make(chan []byte, 100),
 		peerConnect:       make(chan peerConnect, 100),
 		peerQ:             make(chan peerReq, 100),
-		forwardQ:          make(chan SealedMsg, 100),
+		forwardQ:          make(chan forwardReq, 100),
+		banned:            make(map[string]bool),
+		muted:             make(map[string]bool),
 		disposeSig:        make(chan bool),
+		stop:              make(chan struct{}),
+		stopped:           make(chan struct{}),
 		growlTokens:       newTokenStore(),
 		op:                make(chan func()),
 		SPubKey:           base64.StdEncoding.EncodeToString(pub[:]),
@@ -154,10 +239,132 @@ func NewRoom(id, name string, h *Hub, predefined bool) *Room {
 	}
 }
 
-// Login an user into the room. It chekcs for room password,
-// user password is the handle belongs to a predefined user.
+// Login an user into the room. It checks for room password,
+// user password if the handle belongs to a predefined user.
 // Generates a session ID and stores it into the store.
-func (r *Room) Login(secret, spubkey string) (*Peer, error) {
+func (r *Room) Login(secret, spubkey, handle, password string) (*Peer, error) {
+	if err := r.authenticate(handle, password); err != nil {
+		return nil, err
+	}
+	peer, err := r.join(secret, spubkey)
+	if err != nil {
+		return nil, err
+	}
+	r.mut.RLock()
+	owner := r.ownerHandles[handle]
+	r.mut.RUnlock()
+	if owner {
+		r.setOwnerSync(peer.PublicKey)
+	}
+	return peer, nil
+}
+
+// LoginWithToken logs an user into the room using an autologin token issued
+// by a growl notification instead of a password. It returns the handle of the
+// predefined user the token was issued for and the sealed secrets of the peers
+// to hand them over.
+func (r *Room) LoginWithToken(token, secret, spubkey string) (*Peer, string, map[string]SealedMsg, error) {
+	handle := r.growlTokens.checkToken(token)
+	if len(handle) < 1 {
+		return nil, "", nil, ErrInvalidToken
+	}
+	peer, err := r.join(secret, spubkey)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return peer, handle, r.sealedSecrets(), nil
+}
+
+// authenticate checks the password of a predefined user if the handle
+// belongs to one, the room password otherwise.
+func (r *Room) authenticate(handle, password string) error {
+	r.mut.RLock()
+	hash, ok := r.userPasswords[handle]
+	roomHash := r.Password
+	r.mut.RUnlock()
+	if ok {
+		if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+			return ErrInvalidUserPassword
+		}
+		return nil
+	}
+	if len(roomHash) > 0 && bcrypt.CompareHashAndPassword(roomHash, []byte(password)) != nil {
+		return ErrInvalidRoomPassword
+	}
+	return nil
+}
+
+// SetPredefinedUsers sets the predefined users of the room,
+// their passwords are hashed and erased from the list.
+func (r *Room) SetPredefinedUsers(users []PredefinedUser) error {
+	var (
+		predefined = make([]PredefinedUser, len(users), len(users))
+		passwords  = make(map[string][]byte, len(users))
+		owners     = make(map[string]bool)
+	)
+	for i, u := range users {
+		if u.Owner {
+			if u.Password == "" {
+				return fmt.Errorf("owner user %q must have a password", u.Name)
+			}
+			owners[u.Name] = true
+		}
+		if u.Password != "" {
+			hash, err := hashPassword(u.Password)
+			if err != nil {
+				return err
+			}
+			passwords[u.Name] = hash
+		}
+		u.Password = ""
+		predefined[i] = u
+	}
+
+	r.mut.Lock()
+	r.PredefinedUsers = predefined
+	r.userPasswords = passwords
+	r.ownerHandles = owners
+	r.mut.Unlock()
+	return nil
+}
+
+// Reconfigure applies the reloaded configuration of a predefined room:
+// its password, users and message of the day. Connected peers stay in the
+// room. The name and the backlog persistence only change on restart.
+func (r *Room) Reconfigure(cfg PredefinedRoom) error {
+	pwdHash, err := hashPassword(cfg.Password)
+	if err != nil {
+		return err
+	}
+	if err := r.SetPredefinedUsers(cfg.Users); err != nil {
+		return err
+	}
+	r.mut.Lock()
+	r.Password = pwdHash
+	r.motd = cfg.Motd
+	r.messageTTL = cfg.MessageTTL
+	r.mut.Unlock()
+	return nil
+}
+
+// SetMotd replaces the message of the day of the room, sent to the peers
+// when they connect.
+func (r *Room) SetMotd(motd string) {
+	r.mut.Lock()
+	r.motd = motd
+	r.mut.Unlock()
+}
+
+// SetGrowlHandler sets the callback fired when a peer notifies an offline
+// predefined user, nil disables the notifications.
+func (r *Room) SetGrowlHandler(fn func(msg, handle, token string)) {
+	r.mut.Lock()
+	r.growlHandler = fn
+	r.mut.Unlock()
+}
+
+// join adds a peer to the room.
+func (r *Room) join(secret, spubkey string) (*Peer, error) {
 	var pubkey [32]byte
 	z, err := base64.StdEncoding.DecodeString(spubkey)
 	if err != nil {
@@ -176,24 +383,26 @@ func (r *Room) Login(secret, spubkey string) (*Peer, error) {
 
 	since := time.Now().UTC()
 
-	var wg sync.WaitGroup
-	wg.Add(1)
 	peer := newPeer(secret, spubkey, pubkey, since, r)
-	r.op <- func() {
-		defer wg.Done()
-		err = r.login(peer)
+	if !r.do(func() { err = r.login(peer) }) {
+		return nil, ErrRoomStopped
 	}
-	wg.Wait()
 	return peer, err
 }
 
 func (r *Room) login(peer *Peer) error {
+	if r.banned[peer.PublicKey] {
+		return ErrBanned
+	}
 	for p := range r.peers {
 		if p.PublicKey == peer.PublicKey {
 			return ErrAlreadyConnected
 		}
 	}
-	if len(r.peers)+1 > r.hub.cfg.MaxPeersPerRoom {
+	if _, ok := r.remotePeers[peer.PublicKey]; ok {
+		return ErrAlreadyConnected
+	}
+	if len(r.peers)+len(r.remotePeers)+1 > r.hub.Config().MaxPeersPerRoom {
 		return ErrRoomCapacityExceded
 	}
 	r.peers[peer] = false
@@ -207,13 +416,16 @@ var (
 	ErrAlreadyConnected    = fmt.Errorf("user is already connected")
 	ErrInvalidToken        = fmt.Errorf("invalid autologin token")
 	ErrRoomCapacityExceded = fmt.Errorf("maximum room cpacity exceeded")
+	ErrBanned              = fmt.Errorf("banned from the room")
+	ErrMaxRooms            = fmt.Errorf("the server has too many rooms, try again later")
+	ErrRoomExists          = fmt.Errorf("a room with the same ID already exists")
+	ErrRoomStopped         = fmt.Errorf("the room is closed")
 )
 
 // HandleGrowlNotifications sends growl notification if target user is offline.
 func (r *Room) HandleGrowlNotifications(fromPeer, to, msg string) {
-	if r.GrowlHandler == nil {
-		return
-	}
+	r.mut.RLock()
+	growl := r.growlHandler
 	var ok bool
 	for _, u := range r.PredefinedUsers {
 		if u.Growl && u.Name == to {
@@ -221,35 +433,29 @@ func (r *Room) HandleGrowlNotifications(fromPeer, to, msg string) {
 			break
 		}
 	}
-	if !ok {
+	r.mut.RUnlock()
+	if growl == nil || !ok {
 		return
 	}
 
-	r.op <- func() {
+	r.queueOp(func() {
 		//generate a login token, send the notification
 		tok := r.growlTokens.createToken(to)
 		if tok != "" {
-			go r.GrowlHandler(msg, fromPeer, tok)
+			go growl(msg, fromPeer, tok)
 		}
-	}
+	})
 }
 
-// GetLoginTokens returns the list of tokens to give peers to authentify peer login.
-func (r *Room) GetLoginTokens(authlogintoken string) (string, map[string]SealedMsg, error) {
-
-	handle := r.growlTokens.checkToken(authlogintoken)
-	if len(handle) < 1 {
-		return "", nil, ErrInvalidToken
-	}
-
+// sealedSecrets returns the secrets of the peers sealed for each of them,
+// peers use them to authentify a peer logged in with a token.
+func (r *Room) sealedSecrets() map[string]SealedMsg {
 	type authsecret struct {
 		Secret string `javascript:"secret"`
 		Date   string `javascript:"date"`
 	}
 	sealedMsgs := map[string]SealedMsg{}
-	var wg sync.WaitGroup
-	wg.Add(1)
-	r.op <- func() {
+	r.do(func() {
 		for p := range r.peers {
 			m := r.sealedMsg(p, authsecret{
 				Secret: p.Secret,
@@ -257,11 +463,8 @@ func (r *Room) GetLoginTokens(authlogintoken string) (string, map[string]SealedM
 			})
 			sealedMsgs[p.PublicKey] = m
 		}
-		wg.Done()
-	}
-	wg.Wait()
-
-	return handle, sealedMsgs, nil
+	})
+	return sealedMsgs
 }
 
 type peerConnect struct {
@@ -270,11 +473,15 @@ type peerConnect struct {
 }
 
 // ConnectPeer connects a peer to the room given a WS connection from an HTTP
-// handler.
+// handler. The connection is closed if the room is stopped.
 func (r *Room) ConnectPeer( /*id, handle,*/ publicKey string, ws *websocket.Conn) {
-	r.peerConnect <- peerConnect{
+	select {
+	case r.peerConnect <- peerConnect{
 		ws:        ws,
 		publicKey: publicKey,
+	}:
+	case <-r.stopped:
+		ws.Close()
 	}
 }
 
@@ -282,10 +489,7 @@ func (r *Room) ConnectPeer( /*id, handle,*/ publicKey string, ws *websocket.Conn
 func (r *Room) GetSession(publicKey string) (store.Sess, bool) {
 	var s store.Sess
 	var ok bool
-	var wg sync.WaitGroup
-	wg.Add(1)
-	r.op <- func() {
-		defer wg.Done()
+	r.do(func() {
 		for p := range r.peers {
 			if p.PublicKey == publicKey {
 				s.PublicKey = publicKey
@@ -294,30 +498,118 @@ func (r *Room) GetSession(publicKey string) (store.Sess, bool) {
 				break
 			}
 		}
-	}
-	wg.Wait()
+	})
 	return s, ok
 }
 
 // Dispose signals the room to notify all connected peer messages, and dispose
-// of itself.
+// of itself. Predefined rooms are not disposed of.
 func (r *Room) Dispose() {
-	r.disposeSig <- true
+	select {
+	case r.disposeSig <- false:
+	case <-r.stopped:
+	}
+}
+
+// ForceDispose disposes of the room even if it is predefined, once it is
+// removed from the configuration.
+func (r *Room) ForceDispose() {
+	select {
+	case r.disposeSig <- true:
+	case <-r.stopped:
+	}
+}
+
+// Info returns the state of the room. It returns false if the room is stopped.
+func (r *Room) Info() (RoomInfo, bool) {
+	var info RoomInfo
+	ok := r.do(func() {
+		info = RoomInfo{
+			ID:           r.ID,
+			Name:         r.Name,
+			Predefined:   r.Predefined,
+			RemotePeers:  len(r.remotePeers),
+			Owner:        r.owner,
+			CreatedAt:    r.CreatedAt,
+			LastActivity: r.lastActivity,
+			ExpiresAt:    r.expiresAt,
+		}
+		for _, connected := range r.peers {
+			if connected {
+				info.Peers++
+			}
+		}
+		r.mut.RLock()
+		info.Motd = r.motd
+		r.mut.RUnlock()
+	})
+	return info, ok
+}
+
+// BroadcastNotice broadcasts a notice of the operators to all connected peers.
+func (r *Room) BroadcastNotice(msg string) {
+	r.BroadcastUnsealed(noticeMsg{Type: TypeNotice, Msg: msg})
+}
+
+// shutdown signals the room to disconnect its peers and stop, keeping it
+// in the store. It returns a channel closed once the room is stopped.
+func (r *Room) shutdown() <-chan struct{} {
+	r.stopOnce.Do(func() { close(r.stop) })
+	return r.stopped
 }
 
 // BroadcastUnsealed broadcasts an unsealed message to all connected peers.
 func (r *Room) BroadcastUnsealed(data interface{} /*, record bool*/) {
-	r.broadcastUnsealed <- data
+	select {
+	case r.broadcastUnsealed <- data:
+	case <-r.stopped:
+	}
 }
 
 // BroadcastSealed broadcasts a sealed message to all connected peers.
 func (r *Room) BroadcastSealed(data SealedMsg /*, record bool*/) {
-	r.broadcastSealed <- r.encode(data)
+	select {
+	case r.broadcastSealed <- r.encode(data):
+	case <-r.stopped:
+	}
 }
 
 // Forward forward a message to the recipient.
 func (r *Room) Forward(data SealedMsg) {
-	r.forwardQ <- data
+	r.forward(forwardReq{msg: data})
+}
+
+// forward queues a message to forward to its recipient.
+func (r *Room) forward(req forwardReq) {
+	select {
+	case r.forwardQ <- req:
+	case <-r.stopped:
+	}
+}
+
+// do runs fn in the room loop and waits for it to return. It returns false
+// if the room is stopped, fn is then not run.
+func (r *Room) do(fn func()) bool {
+	done := make(chan struct{})
+	select {
+	case r.op <- func() {
+		defer close(done)
+		fn()
+	}:
+	case <-r.stopped:
+		return false
+	}
+	<-done
+	return true
+}
+
+// queueOp queues fn to run in the room loop without waiting for it.
+// It is dropped if the room is stopped.
+func (r *Room) queueOp(fn func()) {
+	select {
+	case r.op <- fn:
+	case <-r.stopped:
+	}
 }
 
 // run is a blocking function that starts the main event loop for a room that
@@ -325,6 +617,24 @@ func (r *Room) Forward(data SealedMsg) {
 // as a goroutine.
 func (r *Room) run() {
 	tMin := time.NewTicker(time.Minute)
+	defer tMin.Stop()
+
+	// Ad-hoc rooms are disposed of once expired, predefined ones never.
+	var (
+		expiry  *time.Timer
+		expiryC <-chan time.Time
+	)
+	if !r.Predefined {
+		r.checkExpiry(time.Now())
+		expiry = time.NewTimer(r.nextExpiryCheck(time.Now()))
+		defer expiry.Stop()
+		expiryC = expiry.C
+	}
+
+	// Whether to remove the room from the store once stopped,
+	// and the reason given to the peers.
+	purge := true
+	reason := TypeRoomDispose
 loop:
 	for {
 		select {
@@ -332,27 +642,66 @@ loop:
 			op()
 
 		// Dispose request.
-		case <-r.disposeSig:
-			if r.Predefined {
+		case force := <-r.disposeSig:
+			if r.Predefined && !force {
 				continue
 			}
+			r.hub.publish(clusterEvent{Type: evRoomDispose, Room: r.ID})
+			break loop
+
+		// The server is shutting down, the room is restored at the next start.
+		case <-r.stop:
+			purge = false
+			reason = TypeServerShutdown
 			break loop
 
-		case sealedMsg, ok := <-r.forwardQ:
+		// Event relayed by another instance of the cluster.
+		case ev := <-r.remoteQ:
+			if ev.Type == evRoomDispose {
+				purge = false
+				break loop
+			}
+			r.handleRemote(ev)
+
+		case req, ok := <-r.forwardQ:
 			if !ok {
 				break loop
 			}
+			// Muted peers can not send messages, to the room nor to its peers.
+			if req.peer != nil && r.muted[req.peer.PublicKey] {
+				r.sendNotice(req.peer, "You are muted in this room.")
+				continue
+			}
+			r.lastActivity = time.Now()
+			metricSealed.Inc()
+			sealedMsg := req.msg
 			if sealedMsg.To == r.SPubKey {
-				r.hub.log.Printf("got unwanted message in Room.run loop, to key must not be the room server key")
+				r.hub.log.Warn("got unwanted message in Room.run loop, to key must not be the room server key", "room", logging.ID(r.ID))
 				continue
 			}
+			exp := r.stampExpiry(&sealedMsg)
 			p := r.peers.byPublicKey(sealedMsg.To)
 			if p != nil {
-				p.SendData(r.encode(sealedMsg))
+				p.sendExpiring(r.encode(sealedMsg), exp)
 				continue
 			}
+
+			// The sender is relayed for the other instances to check it is
+			// not muted.
+			ev := clusterEvent{Type: evForward, Room: r.ID, Data: r.encode(sealedMsg)}
+			if req.peer != nil {
+				ev.Peer = &peerMsg{PublicKey: req.peer.PublicKey}
+			}
+			r.hub.publish(ev)
+			if _, ok := r.remotePeers[sealedMsg.To]; ok {
+				continue
+			}
+
+			// The message is addressed to the room.
+			b := r.encode(sealedMsg)
+			r.backlog.add(b, exp)
 			for p := range r.peers {
-				p.SendData(r.encode(sealedMsg))
+				p.sendExpiring(b, exp)
 			}
 
 		case info, ok := <-r.peerConnect:
@@ -365,27 +714,48 @@ loop:
 				info.ws.WriteControl(websocket.CloseMessage,
 					websocket.FormatCloseMessage(websocket.CloseNormalClosure, TypeMustLogin), time.Time{})
 				info.ws.Close()
-				r.hub.log.Printf("peer %q did not login", info.publicKey)
+				r.hub.log.Info("peer did not login", "room", logging.ID(r.ID), "peer", logging.ID(info.publicKey))
 				continue
 			}
 
 			peer.Connect(info.ws)
 			go peer.RunListener()
 			go peer.RunWriter()
+			if !r.peers[peer] {
+				metricPeers.Inc()
+			}
 			r.peers[peer] = true
 
+			// The burn countdown brings the deadline of the room forward.
+			if r.burn() {
+				r.timestamp = time.Time{}
+				if !expiry.Stop() {
+					<-expiry.C
+				}
+				expiry.Reset(r.nextExpiryCheck(time.Now()))
+			}
+			r.extendTTL()
+
 			// Send the peer its info.
-			data := peerListMsg{Type: TypePeerList, Peers: r.peers.peerMsgList(true)}
+			data := peerListMsg{Type: TypePeerList, Peers: r.peerMsgList(), Owner: r.owner}
 			peer.SendData(r.sealData(peer, data))
 
-			if len(r.motd) > 0 {
+			r.mut.RLock()
+			motdText := r.motd
+			r.mut.RUnlock()
+			if len(motdText) > 0 {
 				motd := motdMsg{
 					Type: TypeMotd,
-					Msg:  r.motd,
+					Msg:  motdText,
 				}
 				peer.SendData(r.sealData(peer, motd))
 			}
 
+			// Replay the messages the peer missed.
+			for _, m := range r.backlog.list(time.Now()) {
+				peer.sendExpiring(m.data, m.expiresAt)
+			}
+
 			// Notify all peers of the new addition.
 			peerJoin := peerMsg{
 				Type:      TypePeerJoin,
@@ -393,7 +763,8 @@ loop:
 				Since:     peer.Since.Format(JSDateFormat),
 			}
 			go r.BroadcastUnsealed(peerJoin)
-			r.hub.log.Printf("%s joined %s", peer.PublicKey, r.ID)
+			r.hub.publish(clusterEvent{Type: evPeerJoin, Room: r.ID, Peer: &peerJoin})
+			r.hub.log.Info("peer joined", "room", logging.ID(r.ID), "peer", logging.ID(peer.PublicKey))
 
 		// Incoming peer request.
 		case req, ok := <-r.peerQ:
@@ -411,11 +782,12 @@ loop:
 					Since:     req.peer.Since.Format(JSDateFormat),
 				}
 				go r.BroadcastUnsealed(peerLeave)
-				r.hub.log.Printf("%s left %s", req.peer.PublicKey, r.ID)
+				r.hub.publish(clusterEvent{Type: evPeerLeave, Room: r.ID, Peer: &peerLeave})
+				r.hub.log.Info("peer left", "room", logging.ID(r.ID), "peer", logging.ID(req.peer.PublicKey))
 
 			// A peer has requested the room's peer list.
 			case TypePeerList:
-				data := peerListMsg{Type: TypePeerList, Peers: r.peers.peerMsgList(true)}
+				data := peerListMsg{Type: TypePeerList, Peers: r.peerMsgList(), Owner: r.owner}
 				req.peer.SendData(r.sealData(req.peer, data))
 			}
 
@@ -425,9 +797,11 @@ loop:
 				break loop
 			}
 
+			metricUnsealed.Inc()
 			for p := range r.peers {
 				p.SendData(r.sealData(p, m))
 			}
+			r.hub.publish(clusterEvent{Type: evBroadcast, Room: r.ID, Data: r.encode(m)})
 
 			r.extendTTL()
 
@@ -437,17 +811,27 @@ loop:
 				break loop
 			}
 
+			metricSealed.Inc()
 			for p := range r.peers {
 				p.SendData(m)
 			}
+			r.hub.publish(clusterEvent{Type: evBroadcastSealed, Room: r.ID, Data: m})
 
 			r.extendTTL()
 
-		// Kill the room after the inactivity period.
-		case <-time.After(r.hub.cfg.RoomAge):
-			break loop
+		// Kill the room once it expired, warning its peers beforehand.
+		// In cluster mode, only the owner of the room removes it from
+		// the store.
+		case <-expiryC:
+			if r.checkExpiry(time.Now()) {
+				purge = r.hub.ownsRoom(r.ID)
+				break loop
+			}
+			expiry.Reset(r.nextExpiryCheck(time.Now()))
 
 		case <-tMin.C:
+			r.backlog.prune(time.Now())
+			r.saveBacklog()
 			for p := range r.peers {
 				if p.ws != nil {
 					continue
@@ -462,44 +846,195 @@ loop:
 		}
 	}
 
-	r.hub.log.Printf("stopped room: %v", r.ID)
-	r.remove()
+	r.hub.log.Info("stopped room", "room", logging.ID(r.ID), "reason", reason)
+	r.remove(purge, reason)
+	close(r.stopped)
 }
 
-// extendTTL extends a room's TTL in the store.
+// extendTTL records the activity of the room, and extends the room's TTL
+// in the store up to its deadline.
 func (r *Room) extendTTL() {
+	r.lastActivity = time.Now()
+
 	// Extend the room's expiry (once every 30 seconds).
 	if !r.Predefined && time.Since(r.timestamp) > time.Duration(30)*time.Second {
 		r.timestamp = time.Now()
+		r.expiresAt = r.deadline()
+		if err := r.hub.saveRoom(r); err != nil {
+			r.hub.log.Error("error saving room to the store", "room", logging.ID(r.ID), "err", err)
+		}
+	}
+}
+
+// record returns the room metadata persisted in the store.
+func (r *Room) record() store.Room {
+	return store.Room{
+		ID:        r.ID,
+		Name:      r.Name,
+		Password:  r.Password,
+		CreatedAt: r.CreatedAt,
+		ExpiresAt: r.expiresAt,
+
+		IdleTimeout: r.idleTimeout,
+		DestroyAt:   r.destroyAt,
+		BurnAfter:   r.burnAfter,
+		BurnAt:      r.burnAt,
+		MessageTTL:  r.messageTTL,
+
+		Owner:      r.owner,
+		OwnerToken: r.ownerToken,
+		Banned:     setList(r.banned),
+		Muted:      setList(r.muted),
 	}
 }
 
-// remove disposes a room by notifying and disconnecting all peers and
-// removing the room from the store.
-func (r *Room) remove() {
-	// Close all peer WS connections.
+// remove disposes a room by notifying and disconnecting all peers with the
+// given reason and removing the room from the hub, and from the store if
+// purge is set.
+func (r *Room) remove(purge bool, reason string) {
+	r.saveBacklog()
+
+	// Close all peer WS connections once their pending messages are sent.
 	for peer := range r.peers {
-		peer.writeWSControl(websocket.CloseMessage,
-			websocket.FormatCloseMessage(websocket.CloseNormalClosure, TypeRoomDispose))
-		delete(r.peers, peer)
+		if reason == TypeServerShutdown {
+			r.sendNotice(peer, "The server is restarting, you will be reconnected shortly.")
+		}
+		peer.closeReason = reason
+		r.removePeer(peer)
 	}
 
-	// Close all room channels.
-	close(r.broadcastUnsealed)
-	close(r.broadcastSealed)
-	close(r.peerQ)
-	close(r.forwardQ)
-	r.hub.removeRoom(r.ID)
+	// The room channels are left open, the listeners of the peers
+	// may still queue their leave requests.
+	r.hub.removeRoom(r.ID, purge)
+	if purge {
+		for _, fn := range r.hub.onDispose {
+			fn(r.ID)
+		}
+	}
+}
+
+// peerMsgList returns the connected peers of the room, including
+// the ones connected to the other instances of the cluster.
+func (r *Room) peerMsgList() []peerMsg {
+	ret := r.peers.peerMsgList(true)
+	for pk, p := range r.remotePeers {
+		ret = append(ret, peerMsg{PublicKey: pk, Since: p.since})
+	}
+	return ret
+}
+
+// queueRemote queues an event relayed by another instance of the cluster.
+// Events are dropped if the room does not keep up.
+func (r *Room) queueRemote(ev clusterEvent) {
+	select {
+	case r.remoteQ <- ev:
+	default:
+		r.hub.log.Warn("dropped cluster event", "room", logging.ID(r.ID), "event", ev.Type)
+	}
+}
+
+// handleRemote processes an event relayed by another instance of the cluster.
+func (r *Room) handleRemote(ev clusterEvent) {
+	switch ev.Type {
+	// Another instance loaded the room, announce the local peers.
+	case evRoomSync:
+		for p := range r.peers {
+			if p.ws == nil {
+				continue
+			}
+			r.hub.publish(clusterEvent{Type: evPeerJoin, Room: r.ID, Peer: &peerMsg{
+				Type:      TypePeerJoin,
+				PublicKey: p.PublicKey,
+				Since:     p.Since.Format(JSDateFormat),
+			}})
+		}
+
+	// Peers are notified by the broadcast following these events.
+	case evPeerJoin:
+		if ev.Peer != nil {
+			r.remotePeers[ev.Peer.PublicKey] = remotePeer{node: ev.Node, since: ev.Peer.Since}
+		}
+	case evPeerLeave:
+		if ev.Peer != nil {
+			delete(r.remotePeers, ev.Peer.PublicKey)
+		}
+
+	// An instance is gone, so are its peers.
+	case evNodeLeave:
+		for pk, rp := range r.remotePeers {
+			if rp.node != ev.Node {
+				continue
+			}
+			delete(r.remotePeers, pk)
+			peerLeave := peerMsg{Type: TypePeerLeave, PublicKey: pk, Since: rp.since}
+			for p := range r.peers {
+				p.SendData(r.sealData(p, peerLeave))
+			}
+		}
+
+	case evRoomAdmin:
+		r.setAdminState(ev.Data)
+
+	case evPeerKick:
+		if ev.Peer != nil {
+			if p := r.peers.byPublicKey(ev.Peer.PublicKey); p != nil {
+				r.disconnectPeer(p, ev.Peer.Type)
+			}
+		}
+
+	case evForward:
+		if ev.Peer != nil && r.muted[ev.Peer.PublicKey] {
+			return
+		}
+		var m SealedMsg
+		if err := json.Unmarshal(ev.Data, &m); err != nil {
+			r.hub.log.Warn("invalid forwarded message", "room", logging.ID(r.ID), "err", err)
+			return
+		}
+		exp := m.expiry()
+		if !exp.IsZero() && !exp.After(time.Now()) {
+			return
+		}
+		if p := r.peers.byPublicKey(m.To); p != nil {
+			p.sendExpiring(ev.Data, exp)
+			return
+		}
+		if _, ok := r.remotePeers[m.To]; ok {
+			return
+		}
+		r.backlog.add(ev.Data, exp)
+		for p := range r.peers {
+			p.sendExpiring(ev.Data, exp)
+		}
+
+	case evBroadcast:
+		for p := range r.peers {
+			p.SendData(r.sealData(p, ev.Data))
+		}
+		r.extendTTL()
+
+	case evBroadcastSealed:
+		for p := range r.peers {
+			p.SendData(ev.Data)
+		}
+		r.extendTTL()
+	}
 }
 
 // queuePeerReq queues a peer addition / removal request to the room.
 func (r *Room) queuePeerReq(reqType string, peer *Peer) {
-	r.peerQ <- peerReq{peer: peer, reqType: reqType}
+	select {
+	case r.peerQ <- peerReq{peer: peer, reqType: reqType}:
+	case <-r.stopped:
+	}
 }
 
 // removePeer removes a peer from the room and broadcasts a message to the
 // room notifying all peers of the action.
 func (r *Room) removePeer(p *Peer) {
+	if r.peers[p] {
+		metricPeers.Dec()
+	}
 	close(p.dataQ)
 	delete(r.peers, p)
 }
@@ -507,39 +1042,39 @@ func (r *Room) removePeer(p *Peer) {
 // HandleMessage handles incoming peer message.
 func (r *Room) HandleMessage(m SealedMsg, peer *Peer) {
 	if m.To != r.SPubKey {
-		r.Forward(m)
+		r.forward(forwardReq{msg: m, peer: peer})
 		return
 	}
 
 	sdata, ok := m.Data.(string)
 	if !ok {
-		r.hub.log.Printf("invalid message type: %T", m.Data)
+		r.hub.log.Warn("invalid message type", "room", logging.ID(r.ID), "type", fmt.Sprintf("%T", m.Data))
 		return
 	}
 
 	b, err := base64.StdEncoding.DecodeString(sdata)
 	if err != nil {
-		r.hub.log.Printf("invalid message data: %v", err)
+		r.hub.log.Warn("invalid message data", "room", logging.ID(r.ID), "err", err)
 		return
 	}
 	var nonce [24]byte
 	z, err := base64.StdEncoding.DecodeString(m.Nonce)
 	if err != nil {
-		r.hub.log.Printf("invalid message nonce: %v", err)
+		r.hub.log.Warn("invalid message nonce", "room", logging.ID(r.ID), "err", err)
 		return
 	}
 	copy(nonce[:], z)
 	var from [32]byte
 	y, err := base64.StdEncoding.DecodeString(m.From)
 	if err != nil {
-		r.hub.log.Printf("invalid message from: %v", err)
+		r.hub.log.Warn("invalid message from", "room", logging.ID(r.ID), "err", err)
 		return
 	}
 	copy(from[:], y)
 
 	x, ok := box.Open(nil, b, &nonce, &from, r.privKey)
 	if !ok {
-		r.hub.log.Printf("invalid message: %v", err)
+		r.hub.log.Warn("invalid message", "room", logging.ID(r.ID))
 		return
 	}
 
@@ -551,7 +1086,21 @@ func (r *Room) HandleMessage(m SealedMsg, peer *Peer) {
 
 	switch dm.Type {
 	case TypeRoomDispose:
-		r.Dispose()
+		r.queueOp(func() {
+			if peer.PublicKey != r.owner {
+				r.sendNotice(peer, "Only the owner of the room can dispose it.")
+				return
+			}
+			go r.Dispose()
+		})
+	case TypePeerKick, TypePeerBan, TypePeerUnban, TypePeerMute, TypePeerUnmute, TypeRoomOwner:
+		var target string
+		if data, ok := dm.Data.(map[string]interface{}); ok {
+			target, _ = data["publicKey"].(string)
+		}
+		r.queueOp(func() {
+			r.handleAdmin(peer, dm.Type, target)
+		})
 	case TypePeerList:
 		r.queuePeerReq(dm.Type, peer)
 	case TypeUploading:
@@ -563,21 +1112,6 @@ func (r *Room) HandleMessage(m SealedMsg, peer *Peer) {
 	// 	p.room.Broadcast(p.room.makeUploadPayload(data, p, m.Type) /*, false*/)
 
 	case TypeUpload:
-		// // 	// Check rate limits and update counters.
-		// // 	now := time.Now()
-		// // 	if p.numMessages > 0 {
-		// // 		if (p.numMessages%p.room.hub.cfg.RateLimitMessages+1) >= p.room.hub.cfg.RateLimitMessages &&
-		// // 			time.Since(p.lastMessage) < p.room.hub.cfg.RateLimitInterval {
-		// // 			// p.room.hub.Store.RemoveSession(p.ID, p.room.ID)
-		// // 			p.writeWSControl(websocket.CloseMessage,
-		// // 				websocket.FormatCloseMessage(websocket.CloseNormalClosure, TypePeerRateLimited))
-		// // 			p.ws.Close()
-		// // 			return
-		// // 		}
-		// // 	}
-		// // 	p.lastMessage = now
-		// // 	p.numMessages++
-		// //
 		// // 	msg, ok := m.Data.(map[string]interface{})
 		// // 	if !ok {
 		// // 		// TODO: Respond
@@ -615,13 +1149,23 @@ func (r *Room) HandleMessage(m SealedMsg, peer *Peer) {
 		r.HandleGrowlNotifications(from, to, msg)
 
 	default:
-		r.hub.log.Printf("invalid message type: %v", dm.Type)
+		r.hub.log.Warn("invalid message type", "room", logging.ID(r.ID), "type", dm.Type)
+	}
+}
+
+// sendNotice sends a notice from the server to the given peer, unless it
+// left the room. It must be called from the room loop, which closes the
+// queues of the peers leaving.
+func (r *Room) sendNotice(p *Peer, msg string) {
+	if _, ok := r.peers[p]; !ok {
+		return
 	}
+	p.SendData(r.sealData(p, noticeMsg{Type: TypeNotice, Msg: msg}))
 }
 
 // sendPeerList sends the peer list to the given peer.
 func (r *Room) sendPeerList(p *Peer) {
-	r.peerQ <- peerReq{reqType: TypePeerList, peer: p}
+	r.queuePeerReq(TypePeerList, p)
 }
 
 // // makeMessagePayload prepares a chat message.
@@ -0,0 +1,317 @@
+// Package logging is a leveled, structured logger writing logfmt or JSON
+// lines. Values wrapped with ID, such as peer public keys and room IDs,
+// are redacted according to the configuration: logged as is, replaced
+// by a keyed hash, or dropped.
+package logging
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a message.
+type Level int
+
+// Levels of the messages, LevelOff disables logging.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+	LevelOff
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+	LevelOff:   "off",
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// Redaction modes of the identifiers.
+const (
+	RedactNone = "none"
+	RedactHash = "hash"
+	RedactDrop = "drop"
+)
+
+// Config represents the logging options.
+type Config struct {
+	// Level is one of debug|info|warn|error|off.
+	Level string `koanf:"level"`
+	// Format is one of text (logfmt)|json.
+	Format string `koanf:"format"`
+	// Redact is one of none|hash|drop.
+	Redact string `koanf:"redact"`
+}
+
+// ID marks a value as an identifier of a peer or a room,
+// which is redacted in the logs.
+type ID string
+
+// Logger writes structured messages of a minimum level.
+type Logger struct {
+	mu     sync.Mutex
+	out    io.Writer
+	level  Level
+	json   bool
+	redact string
+	// key of the hashes of the identifiers, random for each process so
+	// that the hashes can not be matched across restarts.
+	key []byte
+	// fields added to every message.
+	fields []interface{}
+	parent *Logger
+}
+
+// New returns a logger writing to out, with the info level, the text
+// format and hashed identifiers until it is configured.
+func New(out io.Writer) *Logger {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Sprintf("failed to generate the logging key: %v", err))
+	}
+	return &Logger{
+		out:    out,
+		level:  LevelInfo,
+		redact: RedactHash,
+		key:    key,
+	}
+}
+
+// Configure applies the configuration to the logger and the ones
+// derived from it with With.
+func (l *Logger) Configure(cfg Config) error {
+	level := LevelInfo
+	if cfg.Level != "" {
+		var ok bool
+		for lv, name := range levelNames {
+			if name == strings.ToLower(cfg.Level) {
+				level, ok = lv, true
+			}
+		}
+		if !ok {
+			return fmt.Errorf("invalid log level %q", cfg.Level)
+		}
+	}
+
+	var isJSON bool
+	switch strings.ToLower(cfg.Format) {
+	case "", "text", "logfmt":
+	case "json":
+		isJSON = true
+	default:
+		return fmt.Errorf("invalid log format %q", cfg.Format)
+	}
+
+	redact := RedactHash
+	switch strings.ToLower(cfg.Redact) {
+	case "":
+	case RedactNone, RedactHash, RedactDrop:
+		redact = strings.ToLower(cfg.Redact)
+	default:
+		return fmt.Errorf("invalid log redaction mode %q", cfg.Redact)
+	}
+
+	root := l.root()
+	root.mu.Lock()
+	root.level, root.json, root.redact = level, isJSON, redact
+	root.mu.Unlock()
+	return nil
+}
+
+// With returns a logger adding the given key and value pairs to every message.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{fields: fields, parent: l.root()}
+}
+
+func (l *Logger) root() *Logger {
+	if l.parent != nil {
+		return l.parent
+	}
+	return l
+}
+
+// Enabled returns true if the messages of the level are logged.
+func (l *Logger) Enabled(level Level) bool {
+	root := l.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	return level >= root.level && root.level != LevelOff
+}
+
+// Debug logs a message with key and value pairs at the debug level.
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.write(LevelDebug, msg, kv)
+}
+
+// Info logs a message with key and value pairs at the info level.
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.write(LevelInfo, msg, kv)
+}
+
+// Warn logs a message with key and value pairs at the warn level.
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.write(LevelWarn, msg, kv)
+}
+
+// Error logs a message with key and value pairs at the error level.
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.write(LevelError, msg, kv)
+}
+
+// Printf logs a formatted message at the info level. The message must not
+// include identifiers, use Info with ID values for them.
+func (l *Logger) Printf(format string, v ...interface{}) {
+	l.write(LevelInfo, fmt.Sprintf(format, v...), nil)
+}
+
+// Fatal logs a message at the error level and exits. It is logged even
+// if logging is off, as the process would otherwise fail silently.
+func (l *Logger) Fatal(v ...interface{}) {
+	l.fatal(fmt.Sprint(v...))
+}
+
+// Fatalf logs a formatted message at the error level and exits.
+func (l *Logger) Fatalf(format string, v ...interface{}) {
+	l.fatal(fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) fatal(msg string) {
+	root := l.root()
+	root.mu.Lock()
+	if root.level == LevelOff {
+		root.level = LevelError
+	}
+	root.mu.Unlock()
+	l.write(LevelError, msg, nil)
+	os.Exit(1)
+}
+
+// Std returns a standard logger writing its lines at the info level,
+// for the packages that expect one.
+func (l *Logger) Std() *log.Logger {
+	return log.New(stdWriter{l}, "", 0)
+}
+
+type stdWriter struct {
+	l *Logger
+}
+
+func (w stdWriter) Write(p []byte) (int, error) {
+	w.l.write(LevelInfo, strings.TrimSpace(string(p)), nil)
+	return len(p), nil
+}
+
+func (l *Logger) write(level Level, msg string, kv []interface{}) {
+	root := l.root()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+	if root.level == LevelOff || level < root.level {
+		return
+	}
+
+	fields := make([]interface{}, 0, 6+len(l.fields)+len(kv))
+	fields = append(fields, "time", time.Now().UTC().Format(time.RFC3339), "level", level.String(), "msg", msg)
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "(missing)")
+	}
+
+	var b bytes.Buffer
+	if root.json {
+		b.WriteByte('{')
+	}
+	first := true
+	for i := 0; i < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		val, ok := root.value(fields[i+1])
+		if !ok {
+			continue
+		}
+		if !first {
+			if root.json {
+				b.WriteByte(',')
+			} else {
+				b.WriteByte(' ')
+			}
+		}
+		first = false
+		if root.json {
+			writeJSON(&b, key)
+			b.WriteByte(':')
+			writeJSON(&b, val)
+			continue
+		}
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(logfmtValue(val))
+	}
+	if root.json {
+		b.WriteByte('}')
+	}
+	b.WriteByte('\n')
+	root.out.Write(b.Bytes())
+}
+
+// value returns the loggable value of v, redacting the identifiers.
+// It returns false if the value must be dropped.
+func (l *Logger) value(v interface{}) (interface{}, bool) {
+	switch x := v.(type) {
+	case ID:
+		switch l.redact {
+		case RedactNone:
+			return string(x), true
+		case RedactDrop:
+			return nil, false
+		}
+		if x == "" {
+			return "", true
+		}
+		h := hmac.New(sha256.New, l.key)
+		h.Write([]byte(x))
+		return hex.EncodeToString(h.Sum(nil)[:8]), true
+	case error:
+		return x.Error(), true
+	case fmt.Stringer:
+		return x.String(), true
+	}
+	return v, true
+}
+
+func writeJSON(b *bytes.Buffer, v interface{}) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		out, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(out)
+}
+
+func logfmtValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " =\"\t\r\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -0,0 +1,183 @@
+// Package metrics exposes counters and gauges in the Prometheus text
+// exposition format. Metrics are registered once, usually as package
+// variables, and served by Handler.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	v uint64
+}
+
+// Inc increments the counter by 1.
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+// Add increments the counter by n.
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+func (c *Counter) value() float64 {
+	return float64(atomic.LoadUint64(&c.v))
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	v int64
+}
+
+// Inc increments the gauge by 1.
+func (g *Gauge) Inc() {
+	atomic.AddInt64(&g.v, 1)
+}
+
+// Dec decrements the gauge by 1.
+func (g *Gauge) Dec() {
+	atomic.AddInt64(&g.v, -1)
+}
+
+// Add adds n to the gauge.
+func (g *Gauge) Add(n int64) {
+	atomic.AddInt64(&g.v, n)
+}
+
+// Set the gauge to n.
+func (g *Gauge) Set(n int64) {
+	atomic.StoreInt64(&g.v, n)
+}
+
+func (g *Gauge) value() float64 {
+	return float64(atomic.LoadInt64(&g.v))
+}
+
+// series is a metric with a set of labels.
+type series struct {
+	labels string
+	value  func() float64
+}
+
+// family groups the series of a metric name.
+type family struct {
+	name   string
+	help   string
+	typ    string
+	series []series
+}
+
+var (
+	mu       sync.Mutex
+	families = map[string]*family{}
+)
+
+// NewCounter registers a counter. labels are name and value pairs,
+// distinguishing the series of a metric name.
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{}
+	register(name, help, "counter", labels, c.value)
+	return c
+}
+
+// NewGauge registers a gauge.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{}
+	register(name, help, "gauge", labels, g.value)
+	return g
+}
+
+// NewGaugeFunc registers a gauge whose value is returned by fn when scraped.
+func NewGaugeFunc(name, help string, fn func() float64, labels ...string) {
+	register(name, help, "gauge", labels, fn)
+}
+
+func register(name, help, typ string, labels []string, fn func() float64) {
+	if len(labels)%2 != 0 {
+		panic(fmt.Sprintf("metrics: odd number of labels for %q", name))
+	}
+	var pairs []string
+	for i := 0; i < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	l := ""
+	if len(pairs) > 0 {
+		l = "{" + strings.Join(pairs, ",") + "}"
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	f, ok := families[name]
+	if !ok {
+		f = &family{name: name, help: help, typ: typ}
+		families[name] = f
+	} else if f.typ != typ {
+		panic(fmt.Sprintf("metrics: %q registered as %s and %s", name, f.typ, typ))
+	}
+	for _, s := range f.series {
+		if s.labels == l {
+			panic(fmt.Sprintf("metrics: duplicate series %s%s", name, l))
+		}
+	}
+	f.series = append(f.series, series{labels: l, value: fn})
+}
+
+// Write writes all the registered metrics in the text exposition format.
+func Write(w io.Writer) error {
+	mu.Lock()
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := make([]family, 0, len(names))
+	for _, name := range names {
+		f := *families[name]
+		f.series = append([]series(nil), f.series...)
+		list = append(list, f)
+	}
+	mu.Unlock()
+
+	b := bufio.NewWriter(w)
+	for _, f := range list {
+		fmt.Fprintf(b, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(b, "# TYPE %s %s\n", f.name, f.typ)
+		for _, s := range f.series {
+			fmt.Fprintf(b, "%s%s %s\n", f.name, s.labels, formatValue(s.value()))
+		}
+	}
+	return b.Flush()
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// Handler serves the registered metrics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := Write(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
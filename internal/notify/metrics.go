@@ -0,0 +1,10 @@
+package notify
+
+import "github.com/knadh/niltalk/internal/metrics"
+
+// Metrics of the growl notifications.
+var (
+	metricGrowlSent    = metrics.NewCounter("niltalk_growl_notifications_total", "Number of growl notifications.", "status", "sent")
+	metricGrowlLimited = metrics.NewCounter("niltalk_growl_notifications_total", "Number of growl notifications.", "status", "ratelimited")
+	metricGrowlFailed  = metrics.NewCounter("niltalk_growl_notifications_total", "Number of growl notifications.", "status", "failed")
+)
@@ -6,7 +6,6 @@ import (
 	"html/template"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"path/filepath"
 	"strconv"
@@ -22,13 +21,14 @@ import (
 	"github.com/faiface/beep/wav"
 	"github.com/gen2brain/beeep"
 	tparse "github.com/karrick/tparse/v2"
+	"github.com/knadh/niltalk/internal/logging"
 	"golang.org/x/time/rate"
 )
 
 type Notifier struct {
 	BaseURL     string
 	RoomID      string
-	Logger      *log.Logger
+	Logger      *logging.Logger
 	Options     Options
 	tpl         *template.Template
 	limiter     *rate.Limiter
@@ -47,7 +47,7 @@ type Options struct {
 	RateLimitBurst  string `koanf:"rate-limit-burst"`
 }
 
-func New(opt Options, baseURL, roomID string, logger *log.Logger, box *rice.Box) *Notifier {
+func New(opt Options, baseURL, roomID string, logger *logging.Logger, box *rice.Box) *Notifier {
 	return &Notifier{
 		Options: opt,
 		BaseURL: baseURL,
@@ -61,7 +61,7 @@ func (n *Notifier) Init() error {
 	{
 		t, err := template.New("").Parse(n.Options.Message)
 		if err != nil {
-			n.Logger.Printf("error compiling growl template for room %q: %v", n.RoomID, err)
+			n.Logger.Error("error compiling growl template", "room", logging.ID(n.RoomID), "err", err)
 			return err
 		}
 		n.tpl = t
@@ -84,7 +84,7 @@ func (n *Notifier) Init() error {
 			r, err = n.box.Open(n.Options.Sound)
 		}
 		if err != nil {
-			n.Logger.Printf("error loading growl sound for room %q: %v", n.RoomID, err)
+			n.Logger.Error("error loading growl sound", "room", logging.ID(n.RoomID), "err", err)
 			return err
 		}
 		var (
@@ -100,12 +100,12 @@ func (n *Notifier) Init() error {
 			streamer, format, err = flac.Decode(r)
 		}
 		if err != nil {
-			n.Logger.Printf("error loading growl sound for room %q: %v", n.RoomID, err)
+			n.Logger.Error("error loading growl sound", "room", logging.ID(n.RoomID), "err", err)
 			return err
 		}
 		err = speaker.Init(format.SampleRate, format.SampleRate.N(time.Second/10))
 		if err != nil {
-			n.Logger.Printf("error initializing sound system for room %q: %v", n.RoomID, err)
+			n.Logger.Error("error initializing sound system", "room", logging.ID(n.RoomID), "err", err)
 			return err
 		}
 		buffer := beep.NewBuffer(format)
@@ -154,6 +154,7 @@ func (n *Notifier) Init() error {
 // OnGrowlMessage handles growl notifications.
 func (n *Notifier) OnGrowlMessage(msg, handle, token string) {
 	if n.limiter != nil && !n.limiter.Allow() {
+		metricGrowlLimited.Inc()
 		return
 	}
 	body := n.Options.Message
@@ -167,13 +168,16 @@ func (n *Notifier) OnGrowlMessage(msg, handle, token string) {
 		"UserName": handle,
 	})
 	if err != nil {
-		n.Logger.Printf("error executing growl template for room %q: %v", n.RoomID, err)
+		n.Logger.Error("error executing growl template", "room", logging.ID(n.RoomID), "err", err)
 	} else {
 		body = s.String()
 	}
 	err = beeep.Notify(n.Options.Title, body, "")
 	if err != nil {
-		n.Logger.Printf("error sending notification for room %q: %v", n.RoomID, err)
+		n.Logger.Error("error sending notification", "room", logging.ID(n.RoomID), "err", err)
+		metricGrowlFailed.Inc()
+	} else {
+		metricGrowlSent.Inc()
 	}
 	speaker.Play(n.soundBuffer.Streamer(0, n.soundBuffer.Len()))
 }
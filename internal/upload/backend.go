@@ -0,0 +1,85 @@
+package upload
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Backend stores the encrypted blobs of the uploads. The Store keeps the
+// index of the files and passes their metadata to the backend, which may
+// persist it to list the files on startup.
+type Backend interface {
+	// Put stores a file, streaming its f.Size bytes of content from r.
+	Put(f File, r io.Reader) error
+	// Open returns the content of a file, ErrFileNotFound if it is gone.
+	Open(f File) (Blob, error)
+	// Delete deletes a file. Deleting a missing file is not an error.
+	Delete(f File) error
+	// List returns the metadata of the stored files.
+	List() ([]File, error)
+}
+
+// Blob is the content of a stored file.
+type Blob interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// errShortFile indicates that a file is shorter than its announced size.
+var errShortFile = errors.New("file shorter than its size")
+
+// memory is the Backend keeping the files in memory, lost on restart.
+type memory struct {
+	mu    sync.Mutex
+	items map[string][]byte
+}
+
+func newMemory() *memory {
+	return &memory{items: make(map[string][]byte)}
+}
+
+func (m *memory) Put(f File, r io.Reader) error {
+	b, err := ioutil.ReadAll(io.LimitReader(r, f.Size))
+	if err != nil {
+		return err
+	}
+	if int64(len(b)) != f.Size {
+		return errShortFile
+	}
+	m.mu.Lock()
+	m.items[f.ID] = b
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memory) Open(f File) (Blob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.items[f.ID]
+	if !ok {
+		return nil, ErrFileNotFound
+	}
+	return memoryBlob{bytes.NewReader(b)}, nil
+}
+
+func (m *memory) Delete(f File) error {
+	m.mu.Lock()
+	delete(m.items, f.ID)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memory) List() ([]File, error) {
+	return nil, nil
+}
+
+type memoryBlob struct {
+	*bytes.Reader
+}
+
+func (memoryBlob) Close() error {
+	return nil
+}
@@ -0,0 +1,186 @@
+package upload
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DiskConfig represents the options of the disk backend.
+type DiskConfig struct {
+	// Path of the directory the files are stored in.
+	Path string `koanf:"path"`
+	// MaxSize is the quota of the stored files.
+	MaxSize string `koanf:"max-size"`
+}
+
+// defaultDiskPath is the directory of the disk backend if none is set.
+const defaultDiskPath = "uploads"
+
+// metaExt is the extension of the metadata file stored next to each file.
+const metaExt = ".json"
+
+// disk is the Backend storing each file in a directory, along with a
+// file of its metadata, so that storing or deleting a file does not
+// rewrite the metadata of the others.
+type disk struct {
+	dir string
+	log *log.Logger
+}
+
+func newDisk(dir string, l *log.Logger) (*disk, error) {
+	if dir == "" {
+		dir = defaultDiskPath
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &disk{dir: dir, log: l}, nil
+}
+
+func (d *disk) Put(f File, r io.Reader) error {
+	if err := writeFile(d.path(f.ID), r, f.Size); err != nil {
+		return err
+	}
+	if err := d.writeMeta(f); err != nil {
+		os.Remove(d.path(f.ID))
+		return err
+	}
+	return nil
+}
+
+func (d *disk) Open(f File) (Blob, error) {
+	fd, err := os.Open(d.path(f.ID))
+	if os.IsNotExist(err) {
+		return nil, ErrFileNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return fd, nil
+}
+
+// Delete deletes the metadata of the file first, a file left without
+// them is deleted on the next start.
+func (d *disk) Delete(f File) error {
+	if err := os.Remove(d.path(f.ID) + metaExt); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(d.path(f.ID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List returns the files from their metadata. The files left without
+// content or metadata by an interruption are deleted.
+func (d *disk) List() ([]File, error) {
+	entries, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		names[e.Name()] = true
+	}
+
+	var out []File
+	for _, e := range entries {
+		name := e.Name()
+		id := strings.TrimSuffix(strings.TrimSuffix(name, ".tmp"), metaExt)
+		if !isID(id) {
+			continue
+		}
+		switch {
+		case strings.HasSuffix(name, ".tmp"):
+			// Interrupted write.
+			d.removeStale(name)
+
+		case strings.HasSuffix(name, metaExt):
+			if !names[id] {
+				d.removeStale(name)
+				continue
+			}
+			b, err := ioutil.ReadFile(filepath.Join(d.dir, name))
+			if err != nil {
+				return nil, err
+			}
+			var f File
+			if err := json.Unmarshal(b, &f); err != nil || f.ID != id {
+				d.log.Printf("invalid upload metadata file %q", name)
+				continue
+			}
+			out = append(out, f)
+
+		case !names[name+metaExt]:
+			d.removeStale(name)
+		}
+	}
+	return out, nil
+}
+
+// removeStale removes a file left behind by an interruption.
+func (d *disk) removeStale(name string) {
+	if err := os.Remove(filepath.Join(d.dir, name)); err != nil && !os.IsNotExist(err) {
+		d.log.Printf("error deleting stale upload %q: %v", name, err)
+	}
+}
+
+// path returns the path of the content of a file. IDs are generated by
+// the store, they are not taken from the requests.
+func (d *disk) path(id string) string {
+	return filepath.Join(d.dir, id)
+}
+
+// writeMeta writes the metadata file of a file.
+func (d *disk) writeMeta(f File) error {
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	return writeFile(d.path(f.ID)+metaExt, bytes.NewReader(b), int64(len(b)))
+}
+
+// isID returns true if s is a file ID generated by newID.
+func isID(s string) bool {
+	if len(s) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// writeFile writes size bytes streamed from r to a file atomically, through
+// a temporary file renamed once synced.
+func writeFile(path string, r io.Reader, size int64) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, io.LimitReader(r, size))
+	if err == nil && n != size {
+		err = errShortFile
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,170 @@
+package upload
+
+import (
+	"container/list"
+	"time"
+)
+
+// index keeps the stored files in least recently used order, globally and
+// per room, and in creation order, so that they are evicted and expired in
+// constant time.
+type index struct {
+	items map[string]*entry
+	rooms map[string]*roomIndex
+	// lru holds the files, most recently used first.
+	lru *list.List
+	// age holds the files, oldest first.
+	age  *list.List
+	size int64
+}
+
+// entry is an indexed file, with its elements in the lists of the index.
+type entry struct {
+	f    File
+	lru  *list.Element
+	age  *list.Element
+	room *list.Element
+}
+
+// roomIndex holds the files of a room, most recently used first.
+type roomIndex struct {
+	lru  *list.List
+	size int64
+}
+
+func newIndex() *index {
+	return &index{
+		items: make(map[string]*entry),
+		rooms: make(map[string]*roomIndex),
+		lru:   list.New(),
+		age:   list.New(),
+	}
+}
+
+// add indexes a file as the most recently used one.
+func (x *index) add(f File) {
+	e := &entry{f: f}
+	e.lru = x.lru.PushFront(e)
+
+	// Files are usually added as they are created, the newest last.
+	mark := x.age.Back()
+	for mark != nil && mark.Value.(*entry).f.CreatedAt.After(f.CreatedAt) {
+		mark = mark.Prev()
+	}
+	if mark == nil {
+		e.age = x.age.PushFront(e)
+	} else {
+		e.age = x.age.InsertAfter(e, mark)
+	}
+
+	r, ok := x.rooms[f.RoomID]
+	if !ok {
+		r = &roomIndex{lru: list.New()}
+		x.rooms[f.RoomID] = r
+	}
+	e.room = r.lru.PushFront(e)
+	r.size += f.Size
+
+	x.items[f.ID] = e
+	x.size += f.Size
+}
+
+// get returns an indexed file.
+func (x *index) get(id string) (File, bool) {
+	e, ok := x.items[id]
+	if !ok {
+		return File{}, false
+	}
+	return e.f, true
+}
+
+// touch marks a file as the most recently used one.
+func (x *index) touch(id string) {
+	e, ok := x.items[id]
+	if !ok {
+		return
+	}
+	x.lru.MoveToFront(e.lru)
+	x.rooms[e.f.RoomID].lru.MoveToFront(e.room)
+}
+
+// remove removes a file from the index.
+func (x *index) remove(id string) (File, bool) {
+	e, ok := x.items[id]
+	if !ok {
+		return File{}, false
+	}
+	delete(x.items, id)
+	x.lru.Remove(e.lru)
+	x.age.Remove(e.age)
+	x.size -= e.f.Size
+
+	r := x.rooms[e.f.RoomID]
+	r.lru.Remove(e.room)
+	r.size -= e.f.Size
+	if r.lru.Len() == 0 {
+		delete(x.rooms, e.f.RoomID)
+	}
+	return e.f, true
+}
+
+// leastUsed returns the least recently used file.
+func (x *index) leastUsed() (File, bool) {
+	el := x.lru.Back()
+	if el == nil {
+		return File{}, false
+	}
+	return el.Value.(*entry).f, true
+}
+
+// leastUsedIn returns the least recently used file of a room.
+func (x *index) leastUsedIn(roomID string) (File, bool) {
+	r, ok := x.rooms[roomID]
+	if !ok {
+		return File{}, false
+	}
+	return r.lru.Back().Value.(*entry).f, true
+}
+
+// roomSize returns the size of the files of a room.
+func (x *index) roomSize(roomID string) int64 {
+	if r, ok := x.rooms[roomID]; ok {
+		return r.size
+	}
+	return 0
+}
+
+// roomFiles returns the files of a room.
+func (x *index) roomFiles(roomID string) []File {
+	r, ok := x.rooms[roomID]
+	if !ok {
+		return nil
+	}
+	out := make([]File, 0, r.lru.Len())
+	for el := r.lru.Front(); el != nil; el = el.Next() {
+		out = append(out, el.Value.(*entry).f)
+	}
+	return out
+}
+
+// roomIDs returns the rooms the files were shared in.
+func (x *index) roomIDs() []string {
+	out := make([]string, 0, len(x.rooms))
+	for id := range x.rooms {
+		out = append(out, id)
+	}
+	return out
+}
+
+// createdBefore returns the files created before t, oldest first.
+func (x *index) createdBefore(t time.Time) []File {
+	var out []File
+	for el := x.age.Front(); el != nil; el = el.Next() {
+		f := el.Value.(*entry).f
+		if !f.CreatedAt.Before(t) {
+			break
+		}
+		out = append(out, f)
+	}
+	return out
+}
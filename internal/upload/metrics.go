@@ -0,0 +1,12 @@
+package upload
+
+import "github.com/knadh/niltalk/internal/metrics"
+
+// Metrics of the uploads.
+var (
+	metricUploadBytes     = metrics.NewCounter("niltalk_upload_bytes_total", "Number of bytes uploaded.")
+	metricStoredBytes     = metrics.NewGauge("niltalk_upload_stored_bytes", "Number of bytes of the stored uploads.")
+	metricStoredFiles     = metrics.NewGauge("niltalk_upload_stored_files", "Number of stored uploads.")
+	metricUploadEvictions = metrics.NewCounter("niltalk_upload_evictions_total", "Number of uploads evicted to fit in the quotas.")
+	metricUploadExpired   = metrics.NewCounter("niltalk_upload_expired_total", "Number of uploads expired by age or with their room.")
+)
@@ -0,0 +1,336 @@
+package upload
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// uploadTTL is how long an upload is kept without receiving a chunk.
+const uploadTTL = time.Hour
+
+// stagingPrefix prefixes the names of the staging directories of the
+// instances, created in the configured staging directory.
+const stagingPrefix = "niltalk-staging-"
+
+var (
+	// ErrUploadNotFound indicates that the upload was not found or expired.
+	ErrUploadNotFound = errors.New("upload not found")
+	// ErrOffsetMismatch indicates that a chunk does not start at the
+	// offset of the upload.
+	ErrOffsetMismatch = errors.New("upload offset mismatch")
+	// ErrUploadBusy indicates that a chunk of the upload is being received.
+	ErrUploadBusy = errors.New("upload in progress")
+	// ErrUploadIncomplete indicates that the upload is finalized before
+	// all its chunks are received.
+	ErrUploadIncomplete = errors.New("upload incomplete")
+	// ErrInvalidLength indicates an invalid upload length.
+	ErrInvalidLength = errors.New("invalid upload length")
+)
+
+// pending is a file being uploaded in chunks, staged in a file until it
+// is complete and finalized, then streamed to the backend.
+type pending struct {
+	roomID   string
+	uploader string
+	length   int64
+	offset   int64
+	// busy is set while a chunk is written.
+	busy   bool
+	expire time.Time
+	path   string
+}
+
+// Create starts the upload of a file of length bytes by a peer of a room,
+// and returns its ID, which is the ID of the file once finalized.
+func (s *Store) Create(roomID, uploader string, length int64) (string, error) {
+	if length <= 0 {
+		return "", ErrInvalidLength
+	}
+	if !s.fits(length) {
+		return "", ErrFileTooLarge
+	}
+	id, err := newID()
+	if err != nil {
+		return "", err
+	}
+	p := &pending{
+		roomID:   roomID,
+		uploader: uploader,
+		length:   length,
+		expire:   time.Now().Add(uploadTTL),
+		path:     filepath.Join(s.stagingDir, id),
+	}
+
+	// The uploads in progress, and the finalized ones still staged while
+	// they are written, are held to the quotas of the stored files, so that
+	// they can not fill the staging directory.
+	s.mu.Lock()
+	if (s.MaxSize > 0 && s.staged+s.writing+length > s.MaxSize) ||
+		(s.MaxRoomSize > 0 && s.stagedRooms[roomID]+s.writingRooms[roomID]+length > s.MaxRoomSize) {
+		s.mu.Unlock()
+		return "", ErrTooManyUploads
+	}
+	s.addUpload(id, p)
+	s.mu.Unlock()
+
+	err = os.MkdirAll(s.stagingDir, 0700)
+	if err == nil {
+		var f *os.File
+		if f, err = os.OpenFile(p.path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600); err == nil {
+			f.Close()
+		}
+	}
+	if err != nil {
+		s.mu.Lock()
+		s.removeUpload(id, p)
+		s.mu.Unlock()
+		return "", err
+	}
+	return id, nil
+}
+
+// Status returns the offset and the length of an upload.
+func (s *Store) Status(roomID, uploader, id string) (int64, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, err := s.getUpload(roomID, uploader, id)
+	if err != nil {
+		return 0, 0, err
+	}
+	return p.offset, p.length, nil
+}
+
+// Append writes a chunk streamed from r at offset, which must be the
+// current offset of the upload. The chunk is cut at the length of the
+// upload. It returns the new offset, which accounts for the bytes
+// received even if the chunk is interrupted, so that it can be resumed.
+func (s *Store) Append(roomID, uploader, id string, offset int64, r io.Reader) (int64, error) {
+	s.mu.Lock()
+	p, err := s.getUpload(roomID, uploader, id)
+	if err != nil {
+		s.mu.Unlock()
+		return 0, err
+	}
+	if p.busy {
+		s.mu.Unlock()
+		return p.offset, ErrUploadBusy
+	}
+	if offset != p.offset {
+		s.mu.Unlock()
+		return p.offset, ErrOffsetMismatch
+	}
+	p.busy = true
+	s.mu.Unlock()
+
+	var n int64
+	f, err := os.OpenFile(p.path, os.O_WRONLY, 0600)
+	if err == nil {
+		if _, err = f.Seek(offset, io.SeekStart); err == nil {
+			n, err = io.Copy(f, io.LimitReader(r, p.length-offset))
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	metricUploadBytes.Add(uint64(n))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p.busy = false
+	p.offset += n
+	p.expire = time.Now().Add(uploadTTL)
+	if _, ok := s.uploads[id]; !ok {
+		// Aborted while the chunk was written.
+		return 0, ErrUploadNotFound
+	}
+	return p.offset, err
+}
+
+// Finalize stores a complete upload as a file.
+func (s *Store) Finalize(roomID, uploader, id string) (File, error) {
+	s.mu.Lock()
+	p, err := s.getUpload(roomID, uploader, id)
+	if err != nil {
+		s.mu.Unlock()
+		return File{}, err
+	}
+	if p.busy {
+		s.mu.Unlock()
+		return File{}, ErrUploadBusy
+	}
+	if p.offset != p.length {
+		s.mu.Unlock()
+		return File{}, ErrUploadIncomplete
+	}
+	s.dropUpload(id, p)
+	s.mu.Unlock()
+
+	defer os.Remove(p.path)
+	f, err := os.Open(p.path)
+	if err != nil {
+		return File{}, err
+	}
+	defer f.Close()
+	return s.Add(id, roomID, uploader, f, p.length)
+}
+
+// Abort cancels an upload.
+func (s *Store) Abort(roomID, uploader, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, err := s.getUpload(roomID, uploader, id)
+	if err != nil {
+		return err
+	}
+	s.removeUpload(id, p)
+	return nil
+}
+
+// getUpload returns an upload of a peer of a room. s.mu must be held.
+func (s *Store) getUpload(roomID, uploader, id string) (*pending, error) {
+	p, ok := s.uploads[id]
+	if !ok || p.roomID != roomID || p.uploader != uploader {
+		return nil, ErrUploadNotFound
+	}
+	return p, nil
+}
+
+// addUpload adds an upload. s.mu must be held.
+func (s *Store) addUpload(id string, p *pending) {
+	s.uploads[id] = p
+	s.staged += p.length
+	s.stagedRooms[p.roomID] += p.length
+}
+
+// dropUpload removes an upload, leaving its staged file. s.mu must be held.
+func (s *Store) dropUpload(id string, p *pending) {
+	delete(s.uploads, id)
+	s.staged -= p.length
+	if s.stagedRooms[p.roomID] -= p.length; s.stagedRooms[p.roomID] <= 0 {
+		delete(s.stagedRooms, p.roomID)
+	}
+}
+
+// removeUpload removes an upload and its staged file. s.mu must be held.
+func (s *Store) removeUpload(id string, p *pending) {
+	s.dropUpload(id, p)
+	if err := os.Remove(p.path); err != nil && !os.IsNotExist(err) {
+		s.log.Printf("error deleting staged upload: %v", err)
+	}
+}
+
+// expireUploads removes the uploads which did not receive a chunk
+// for uploadTTL.
+func (s *Store) expireUploads(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, p := range s.uploads {
+		if !p.busy && p.expire.Before(now) {
+			s.removeUpload(id, p)
+		}
+	}
+}
+
+// initStaging creates the staging directory of the instance in the
+// configured one, and removes the ones left behind by the instances which
+// did not shut down cleanly. The directory of the disk backend can not be
+// used, nor any directory containing it.
+func (s *Store) initStaging() error {
+	base := s.cfg.StagingDir
+	if base == "" {
+		base = os.TempDir()
+	}
+	if err := os.MkdirAll(base, 0700); err != nil {
+		return fmt.Errorf("error creating the upload staging directory: %v", err)
+	}
+	if s.cfg.Backend == "disk" {
+		disk := s.cfg.Disk.Path
+		if disk == "" {
+			disk = defaultDiskPath
+		}
+		if contains(base, disk) {
+			return fmt.Errorf("upload.staging-dir %q must not contain upload.disk.path %q", base, disk)
+		}
+	}
+
+	s.removeStaleStaging(base)
+	dir, err := ioutil.TempDir(base, stagingPrefix)
+	if err != nil {
+		return fmt.Errorf("error creating the upload staging directory: %v", err)
+	}
+	s.stagingDir = dir
+	return nil
+}
+
+// removeStaleStaging removes the staging directories of the instances
+// in base in which no file was written for uploadTTL. The uploads staged
+// in them expired, and the instances either stopped or recreate them.
+func (s *Store) removeStaleStaging(base string) {
+	dirs, err := ioutil.ReadDir(base)
+	if err != nil {
+		s.log.Printf("error listing the upload staging directory: %v", err)
+		return
+	}
+	deadline := time.Now().Add(-uploadTTL)
+	for _, d := range dirs {
+		if !d.IsDir() || !strings.HasPrefix(d.Name(), stagingPrefix) || d.ModTime().After(deadline) {
+			continue
+		}
+		dir := filepath.Join(base, d.Name())
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		stale := true
+		for _, f := range files {
+			if !f.Mode().IsRegular() || f.ModTime().After(deadline) {
+				stale = false
+				break
+			}
+		}
+		if !stale {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			s.log.Printf("error deleting stale upload staging directory: %v", err)
+		}
+	}
+}
+
+// contains returns true if the directory dir is, or contains, path.
+func contains(dir, path string) bool {
+	abs := func(p string) string {
+		if x, err := filepath.EvalSymlinks(p); err == nil {
+			p = x
+		}
+		if x, err := filepath.Abs(p); err == nil {
+			p = x
+		}
+		return p
+	}
+	rel, err := filepath.Rel(abs(dir), abs(path))
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Close removes the staging directory of the instance, the uploads in
+// progress are lost.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, p := range s.uploads {
+		s.dropUpload(id, p)
+	}
+	if s.stagingDir == "" {
+		return nil
+	}
+	return os.RemoveAll(s.stagingDir)
+}
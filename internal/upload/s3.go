@@ -0,0 +1,324 @@
+package upload
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Config represents the options of the S3-compatible object store backend.
+type S3Config struct {
+	// Endpoint is the base URL of the object store, ie https://s3.amazonaws.com
+	// or http://localhost:9000.
+	Endpoint  string `koanf:"endpoint"`
+	Region    string `koanf:"region"`
+	Bucket    string `koanf:"bucket"`
+	Prefix    string `koanf:"prefix"`
+	AccessKey string `koanf:"access-key"`
+	SecretKey string `koanf:"secret-key"`
+	// MaxSize is the quota of the stored files, required.
+	MaxSize string `koanf:"max-size"`
+	// Timeout bounds connecting to the object store and waiting for its
+	// responses, not the transfers of the bodies which may take longer.
+	Timeout string `koanf:"timeout"`
+}
+
+// unsignedPayload is signed instead of the hash of the streamed bodies.
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// s3 is the Backend storing the files in a bucket of an S3-compatible
+// object store, with path-style requests signed with AWS Signature V4.
+// Objects are keyed by prefix/roomID/fileID so that the files can be
+// listed on startup.
+type s3 struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+func newS3(cfg S3Config, timeout time.Duration) (*s3, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("upload.s3.endpoint and upload.s3.bucket are required")
+	}
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upload.s3.endpoint: %v", err)
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	// A client timeout would cut the large transfers, and the downloads
+	// streamed to slow peers.
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.DialContext = (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext
+	tr.TLSHandshakeTimeout = timeout
+	tr.ResponseHeaderTimeout = timeout
+	return &s3{
+		cfg:      cfg,
+		endpoint: u,
+		client:   &http.Client{Transport: tr},
+	}, nil
+}
+
+func (s *s3) key(f File) string {
+	return s.cfg.Prefix + f.RoomID + "/" + f.ID
+}
+
+// Put streams the file to the object store, its payload is not signed.
+func (s *s3) Put(f File, r io.Reader) error {
+	h := http.Header{}
+	h.Set("Content-Type", "application/octet-stream")
+	resp, err := s.do(http.MethodPut, s.key(f), nil, io.LimitReader(r, f.Size), f.Size, h)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Open checks that the object exists and returns it, fetched with a
+// ranged request from the current offset on the first read after each seek.
+func (s *s3) Open(f File) (Blob, error) {
+	resp, err := s.do(http.MethodHead, s.key(f), nil, nil, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return &s3Object{s: s, f: f}, nil
+}
+
+func (s *s3) Delete(f File) error {
+	resp, err := s.do(http.MethodDelete, s.key(f), nil, nil, 0, nil)
+	if err == ErrFileNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// List lists the objects under the prefix. The uploaders of the files
+// are not listed.
+func (s *s3) List() ([]File, error) {
+	type listResult struct {
+		Contents []struct {
+			Key          string    `xml:"Key"`
+			Size         int64     `xml:"Size"`
+			LastModified time.Time `xml:"LastModified"`
+		} `xml:"Contents"`
+		IsTruncated           bool   `xml:"IsTruncated"`
+		NextContinuationToken string `xml:"NextContinuationToken"`
+	}
+
+	var (
+		out   []File
+		token string
+	)
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {s.cfg.Prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := s.do(http.MethodGet, "", q, nil, 0, nil)
+		if err != nil {
+			return nil, err
+		}
+		var res listResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range res.Contents {
+			parts := strings.Split(strings.TrimPrefix(c.Key, s.cfg.Prefix), "/")
+			if len(parts) != 2 {
+				continue
+			}
+			out = append(out, File{
+				ID:        parts[1],
+				RoomID:    parts[0],
+				Size:      c.Size,
+				CreatedAt: c.LastModified,
+			})
+		}
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			return out, nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+// do sends a signed request for an object of the bucket, or the bucket
+// itself if key is empty, with a body of size bytes if it is not nil.
+// It returns ErrFileNotFound on 404 and an error on the other non 2xx
+// responses.
+func (s *s3) do(method, key string, q url.Values, body io.Reader, size int64, h http.Header) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.cfg.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	// The canonical query of the signature encodes spaces as %20.
+	u.RawQuery = strings.Replace(q.Encode(), "+", "%20", -1)
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	payloadHash := hashHex(nil)
+	if body != nil {
+		req.ContentLength = size
+		payloadHash = unsignedPayload
+		// Empty bodies would be sent chunked, without a length.
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	s.sign(req, payloadHash, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		// The URL holds the room ID, which must not reach the logs.
+		if uerr, ok := err.(*url.Error); ok {
+			err = uerr.Err
+		}
+		return nil, fmt.Errorf("s3 %s request failed: %v", method, err)
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrFileNotFound
+	}
+	return nil, fmt.Errorf("s3 %s request failed: %s", method, resp.Status)
+}
+
+// sign adds the AWS Signature V4 headers to a request.
+func (s *s3) sign(req *http.Request, payloadHash string, now time.Time) {
+	var (
+		amzDate = now.Format("20060102T150405Z")
+		date    = now.Format("20060102")
+		scope   = date + "/" + s.cfg.Region + "/s3/aws4_request"
+	)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// Sign the host and the x-amz-* headers.
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-amz-") {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	canonReq := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonHeaders.String(),
+		signed,
+		payloadHash,
+	}, "\n")
+	toSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hashHex([]byte(canonReq))}, "\n")
+
+	k := hmacSum([]byte("AWS4"+s.cfg.SecretKey), date)
+	k = hmacSum(k, s.cfg.Region)
+	k = hmacSum(k, "s3")
+	k = hmacSum(k, "aws4_request")
+	sig := hex.EncodeToString(hmacSum(k, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKey, scope, signed, sig))
+}
+
+func hashHex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSum(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Object reads an object with ranged requests.
+type s3Object struct {
+	s    *s3
+	f    File
+	off  int64
+	body io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.off >= o.f.Size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		h := http.Header{}
+		h.Set("Range", fmt.Sprintf("bytes=%d-", o.off))
+		resp, err := o.s.do(http.MethodGet, o.s.key(o.f), nil, nil, 0, h)
+		if err != nil {
+			return 0, err
+		}
+		o.body = resp.Body
+	}
+	n, err := o.body.Read(p)
+	o.off += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	var off int64
+	switch whence {
+	case io.SeekStart:
+		off = offset
+	case io.SeekCurrent:
+		off = o.off + offset
+	case io.SeekEnd:
+		off = o.f.Size + offset
+	}
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off != o.off && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.off = off
+	return off, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body != nil {
+		return o.body.Close()
+	}
+	return nil
+}
@@ -1,9 +1,13 @@
 package upload
 
 import (
-	"crypto/sha1"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
+	"log"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -14,40 +18,63 @@ import (
 
 // Config represents the file upload options.
 type Config struct {
-	MaxMemory       string `koanf:"max-memory"`
-	MaxUploadSize   string `koanf:"max-upload-size"`
+	// Backend is one of memory|disk|s3.
+	Backend       string `koanf:"backend"`
+	MaxMemory     string `koanf:"max-memory"`
+	MaxUploadSize string `koanf:"max-upload-size"`
+	// MaxRoomSize is the quota of the files of each room.
+	MaxRoomSize     string `koanf:"max-room-size"`
 	MaxAge          string `koanf:"max-age"`
 	RateLimitPeriod string `koanf:"rate-limit-period"`
 	RateLimitCount  string `koanf:"rate-limit-count"`
 	RateLimitBurst  string `koanf:"rate-limit-burst"`
+	// StagingDir holds the directories of the instances, in which the
+	// files being uploaded in chunks are staged.
+	StagingDir string `koanf:"staging-dir"`
+
+	Disk DiskConfig `koanf:"disk"`
+	S3   S3Config   `koanf:"s3"`
 }
 
-// Store file uploads in memory.
+// Store indexes the file uploads, whose content is kept by a Backend.
 type Store struct {
-	cfg   Config
-	mu    sync.Mutex
-	items map[string]File
-	size  int64
+	cfg     Config
+	backend Backend
+	log     *log.Logger
+	mu      sync.Mutex
+	// idx indexes the stored files.
+	idx *index
+	// uploads are the files being uploaded in chunks, staged in stagingDir.
+	// Their lengths are summed in staged, and per room in stagedRooms.
+	uploads     map[string]*pending
+	stagingDir  string
+	staged      int64
+	stagedRooms map[string]int64
+	// writing sums the sizes of the files being written to the backend,
+	// and writingRooms per room. They are indexed once written.
+	writing      int64
+	writingRooms map[string]int64
 
-	MaxMemory     int64
+	// MaxSize is the quota of the stored files, 0 if unlimited.
+	MaxSize int64
+	// MaxRoomSize is the quota of the files of each room, 0 if unlimited.
+	// A room over its quota evicts its own files.
+	MaxRoomSize   int64
 	MaxUploadSize int64
-	MaxAge        time.Duration
-	RlPeriod      time.Duration
-	RlCount       float64
-	RlBurst       int
+	// MaxAge is the lifetime of the files.
+	MaxAge   time.Duration
+	RlPeriod time.Duration
+	RlCount  float64
+	RlBurst  int
+
+	// RoomExists reports whether a room exists, the files of the other
+	// rooms are expired. It must be set before Init.
+	RoomExists func(roomID string) bool
 }
 
-//Init the store, parsing configuration values.
+// Init the store, parsing configuration values and loading the index
+// of the files from the backend.
 func (s *Store) Init() error {
-	s.MaxMemory = 32 << 20
-	if s.cfg.MaxMemory != "" {
-		x, err := units.ParseStrictBytes(s.cfg.MaxMemory)
-		if err != nil {
-			return fmt.Errorf("error unmarshalling 'upload.max-memory' config: %v", err)
-		}
-		s.MaxMemory = x
-	}
-
 	s.MaxUploadSize = 32 << 20
 	if s.cfg.MaxUploadSize != "" {
 		x, err := units.ParseStrictBytes(s.cfg.MaxUploadSize)
@@ -92,77 +119,324 @@ func (s *Store) Init() error {
 		}
 		s.RlBurst = x
 	}
+
+	if err := s.initBackend(); err != nil {
+		return err
+	}
+	if err := s.initStaging(); err != nil {
+		return err
+	}
+
+	// Rooms get a quarter of the quota by default.
+	s.MaxRoomSize = s.MaxSize / 4
+	if s.cfg.MaxRoomSize != "" {
+		x, err := units.ParseStrictBytes(s.cfg.MaxRoomSize)
+		if err != nil {
+			return fmt.Errorf("error unmarshalling 'upload.max-room-size' config: %v", err)
+		}
+		s.MaxRoomSize = x
+	}
+
+	files, err := s.backend.List()
+	if err != nil {
+		return fmt.Errorf("error listing the uploads: %v", err)
+	}
+	// The files are considered used in the order they were created.
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].CreatedAt.Before(files[j].CreatedAt)
+	})
+	for _, f := range files {
+		s.idx.add(f)
+	}
+	s.setMetrics()
+
+	s.expireFiles(time.Now())
+	go s.expire()
+	return nil
+}
+
+// initBackend creates the configured backend and sets its quota.
+func (s *Store) initBackend() error {
+	switch s.cfg.Backend {
+	case "", "memory":
+		s.MaxSize = 32 << 20
+		if s.cfg.MaxMemory != "" {
+			x, err := units.ParseStrictBytes(s.cfg.MaxMemory)
+			if err != nil {
+				return fmt.Errorf("error unmarshalling 'upload.max-memory' config: %v", err)
+			}
+			s.MaxSize = x
+		}
+		s.backend = newMemory()
+
+	case "disk":
+		s.MaxSize = 1 << 30
+		if s.cfg.Disk.MaxSize != "" {
+			x, err := units.ParseStrictBytes(s.cfg.Disk.MaxSize)
+			if err != nil {
+				return fmt.Errorf("error unmarshalling 'upload.disk.max-size' config: %v", err)
+			}
+			s.MaxSize = x
+		}
+		b, err := newDisk(s.cfg.Disk.Path, s.log)
+		if err != nil {
+			return fmt.Errorf("error initializing the upload directory: %v", err)
+		}
+		s.backend = b
+
+	case "s3":
+		// The quota of the rooms and of the uploads in progress derive from it.
+		if s.cfg.S3.MaxSize == "" {
+			return errors.New("upload.s3.max-size is required")
+		}
+		x, err := units.ParseStrictBytes(s.cfg.S3.MaxSize)
+		if err != nil {
+			return fmt.Errorf("error unmarshalling 'upload.s3.max-size' config: %v", err)
+		}
+		s.MaxSize = x
+		timeout := time.Second * 30
+		if s.cfg.S3.Timeout != "" {
+			x, err := tparse.AbsoluteDuration(time.Now(), s.cfg.S3.Timeout)
+			if err != nil {
+				return fmt.Errorf("error unmarshalling 'upload.s3.timeout' config: %v", err)
+			}
+			timeout = x
+		}
+		b, err := newS3(s.cfg.S3, timeout)
+		if err != nil {
+			return err
+		}
+		s.backend = b
+
+	default:
+		return fmt.Errorf("unknown upload backend %q, must be one of memory|disk|s3", s.cfg.Backend)
+	}
 	return nil
 }
 
-// File represents an upload.
+// File represents an upload. Files are encrypted by the clients, which
+// share their name, type and key in sealed messages: the store only holds
+// opaque blobs.
 type File struct {
-	CreatedAt time.Time
-	Data      []byte
-	ID        string
-	Name      string
-	MimeType  string
+	CreatedAt time.Time `json:"created_at"`
+	ID        string    `json:"id"`
+	Size      int64     `json:"size"`
+	// RoomID is the room the file was shared in, it can only be
+	// fetched from there.
+	RoomID string `json:"room_id"`
+	// Uploader is the public key of the peer who uploaded the file. It is
+	// only kept in memory, the backends do not persist the peer IDs.
+	Uploader string `json:"-"`
 }
 
 // New returns a new file uplod store.
-func New(cfg Config) *Store {
+func New(cfg Config, l *log.Logger) *Store {
 	return &Store{
-		cfg:   cfg,
-		items: make(map[string]File),
+		cfg:          cfg,
+		log:          l,
+		idx:          newIndex(),
+		uploads:      make(map[string]*pending),
+		stagedRooms:  make(map[string]int64),
+		writingRooms: make(map[string]int64),
 	}
 }
 
-// Add a new item to the store.
-func (s *Store) Add(name, mimeType string, data []byte) (File, error) {
-	if int64(len(data)) > s.MaxUploadSize {
+// Add a new encrypted blob uploaded by a peer of a room to the store,
+// streaming its size bytes from r to the backend. The least recently used
+// files are evicted if needed to fit it in the quotas. The file is indexed
+// once written, so that it can not be opened, evicted or expired before.
+func (s *Store) Add(id, roomID, uploader string, r io.Reader, size int64) (File, error) {
+	if !s.fits(size) {
 		return File{}, ErrFileTooLarge
 	}
-	h := sha1.New()
-	h.Write(data)
-	id := fmt.Sprintf("%x", h.Sum(nil))
+	up := File{
+		CreatedAt: time.Now(),
+		ID:        id,
+		Size:      size,
+		RoomID:    roomID,
+		Uploader:  uploader,
+	}
+
+	s.mu.Lock()
+	evicted := s.evict(roomID, size)
+	s.writing += size
+	s.writingRooms[roomID] += size
+	s.mu.Unlock()
+	s.delete(evicted)
+
+	err := s.backend.Put(up, r)
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	up, ok := s.items[id]
-	if ok {
-		return up, nil
-	}
-	up.CreatedAt = time.Now()
-	up.ID = id
-	up.Name = name
-	up.MimeType = mimeType
-	up.Data = make([]byte, len(data), len(data))
-	copy(up.Data, data)
-	s.items[id] = up
-	s.size += int64(len(data))
-	for s.size > s.MaxMemory {
-		var oldest *File
-		for _, up := range s.items {
-			if oldest == nil {
-				oldest = &up
-			} else if up.CreatedAt.Before(oldest.CreatedAt) {
-				oldest = &up
-			}
+	s.writing -= size
+	if s.writingRooms[roomID] -= size; s.writingRooms[roomID] <= 0 {
+		delete(s.writingRooms, roomID)
+	}
+	if err != nil {
+		return File{}, err
+	}
+	s.idx.add(up)
+	s.setMetrics()
+	return up, nil
+}
+
+// fits returns true if a file of the given size fits in the quotas.
+func (s *Store) fits(size int64) bool {
+	return size <= s.MaxUploadSize &&
+		(s.MaxSize == 0 || size <= s.MaxSize) &&
+		(s.MaxRoomSize == 0 || size <= s.MaxRoomSize)
+}
+
+// evict removes the least recently used files from the index until size
+// more bytes fit in the quotas along with the files being written, and
+// returns them to be deleted from the backend. A room over its quota evicts
+// its own files first, so that it can not evict the files of the other rooms
+// beyond its share.
+func (s *Store) evict(roomID string, size int64) []File {
+	var out []File
+	for s.MaxRoomSize > 0 && s.idx.roomSize(roomID)+s.writingRooms[roomID]+size > s.MaxRoomSize {
+		f, ok := s.idx.leastUsedIn(roomID)
+		if !ok {
+			break
 		}
-		if oldest != nil {
-			s.size -= int64(len(oldest.Data))
-			delete(s.items, oldest.ID)
+		s.idx.remove(f.ID)
+		out = append(out, f)
+		metricUploadEvictions.Inc()
+	}
+	for s.MaxSize > 0 && s.idx.size+s.writing+size > s.MaxSize {
+		f, ok := s.idx.leastUsed()
+		if !ok {
+			break
 		}
+		s.idx.remove(f.ID)
+		out = append(out, f)
+		metricUploadEvictions.Inc()
+	}
+	return out
+}
+
+// remove removes a file from the index.
+func (s *Store) remove(id string) {
+	if _, ok := s.idx.remove(id); ok {
+		s.setMetrics()
 	}
-	if len(s.items) < 1 {
-		return up, ErrFileTooLarge
+}
+
+// delete deletes files removed from the index from the backend.
+func (s *Store) delete(files []File) {
+	for _, f := range files {
+		if err := s.backend.Delete(f); err != nil {
+			s.log.Printf("error deleting upload: %v", err)
+		}
 	}
-	return up, nil
 }
 
-// Get the file with given id.
-func (s *Store) Get(id string) (File, error) {
+func (s *Store) setMetrics() {
+	metricStoredBytes.Set(s.idx.size)
+	metricStoredFiles.Set(int64(len(s.idx.items)))
+}
+
+// Open returns the file with given id, shared in the given room, and its
+// content to be closed once read.
+func (s *Store) Open(roomID, id string) (File, Blob, error) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	up, ok := s.items[id]
-	if !ok {
-		return up, ErrFileNotFound
+	up, ok := s.idx.get(id)
+	if ok && up.RoomID == roomID {
+		s.idx.touch(id)
 	}
-	return up, nil
+	s.mu.Unlock()
+	if !ok || up.RoomID != roomID {
+		return File{}, nil, ErrFileNotFound
+	}
+
+	b, err := s.backend.Open(up)
+	if err == ErrFileNotFound {
+		s.mu.Lock()
+		s.remove(id)
+		s.mu.Unlock()
+	}
+	if err != nil {
+		return File{}, nil, err
+	}
+	return up, b, nil
+}
+
+// DeleteRoom deletes the files shared in a room, and aborts its uploads.
+func (s *Store) DeleteRoom(roomID string) {
+	s.mu.Lock()
+	files := s.removeRoom(roomID)
+	for id, p := range s.uploads {
+		if p.roomID == roomID {
+			s.removeUpload(id, p)
+		}
+	}
+	s.mu.Unlock()
+	s.delete(files)
+}
+
+// removeRoom removes the files of a room from the index, and returns them
+// to be deleted from the backend. s.mu must be held.
+func (s *Store) removeRoom(roomID string) []File {
+	files := s.idx.roomFiles(roomID)
+	for _, f := range files {
+		s.idx.remove(f.ID)
+	}
+	s.setMetrics()
+	return files
+}
+
+// expire periodically removes the expired files and uploads.
+func (s *Store) expire() {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for range t.C {
+		now := time.Now()
+		s.expireFiles(now)
+		s.expireUploads(now)
+	}
+}
+
+// expireFiles deletes the files older than MaxAge, and the files of the
+// rooms which do not exist anymore.
+func (s *Store) expireFiles(now time.Time) {
+	var (
+		files []File
+		rooms []string
+	)
+	s.mu.Lock()
+	if s.MaxAge > 0 {
+		for _, f := range s.idx.createdBefore(now.Add(-s.MaxAge)) {
+			s.idx.remove(f.ID)
+			files = append(files, f)
+		}
+		s.setMetrics()
+	}
+	if s.RoomExists != nil {
+		rooms = s.idx.roomIDs()
+	}
+	s.mu.Unlock()
+
+	// The rooms are checked without holding the lock.
+	for _, id := range rooms {
+		if s.RoomExists(id) {
+			continue
+		}
+		s.mu.Lock()
+		files = append(files, s.removeRoom(id)...)
+		s.mu.Unlock()
+	}
+
+	metricUploadExpired.Add(uint64(len(files)))
+	s.delete(files)
+}
+
+// newID returns a random, unguessable file ID.
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
 
 // ErrFileNotFound indicates that the requested file was not found.
@@ -170,3 +444,7 @@ var ErrFileNotFound = errors.New("file not found")
 
 // ErrFileTooLarge indicates that the file was too large.
 var ErrFileTooLarge = errors.New("file too large")
+
+// ErrTooManyUploads indicates that the uploads in progress would exceed
+// the quotas.
+var ErrTooManyUploads = errors.New("too many uploads in progress, try again later")
@@ -4,10 +4,11 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"html/template"
-	"log"
 	"net"
 	"net/http"
 	"os"
@@ -26,13 +27,16 @@ import (
 	"github.com/knadh/koanf/providers/posflag"
 	"github.com/knadh/koanf/providers/rawbytes"
 	"github.com/knadh/niltalk/internal/hub"
+	"github.com/knadh/niltalk/internal/logging"
+	"github.com/knadh/niltalk/internal/metrics"
 	"github.com/knadh/niltalk/internal/upload"
+	"github.com/knadh/niltalk/store"
 	flag "github.com/spf13/pflag"
 	"golang.org/x/crypto/acme/autocert"
 )
 
 var (
-	logger = log.New(os.Stderr, "", log.Ldate|log.Ltime|log.Lshortfile)
+	logger = logging.New(os.Stderr)
 	ko     = koanf.New(".")
 
 	// Version of the build injected at build time.
@@ -41,14 +45,17 @@ var (
 
 // App is the global app context that's passed around.
 type App struct {
-	hub          *hub.Hub
+	hub *hub.Hub
+	// cfg is the configuration the app started with,
+	// hub.Config() returns the current one.
 	cfg          *hub.Config
 	tpls         map[string]*template.Template
 	themesBox    *rice.Box
 	jit          bool
-	logger       *log.Logger
+	logger       *logging.Logger
 	localAddress string
 	qrConfig     qrConfig
+	roomLimiter  *roomCreationLimiter
 }
 
 func loadConfig() {
@@ -67,6 +74,12 @@ func loadConfig() {
 	f.Bool("version", false, "Show build version")
 	f.Bool("extract-themes", false, "Extract themes assets")
 	f.Bool("jit", defaultJIT, "build templates just in time")
+	f.Bool("rotate-store-key", false, "Re-encrypt the store with the key of --new-store-key-file")
+	f.String("new-store-key-file", "", "Path to the file holding the new store encryption key")
+	f.Bool("migrate-store", false, "Copy every key of the --from store to the --to store")
+	f.String("from", "", "Store kind to migrate from (redis|memory|fs|bolt)")
+	f.String("to", "", "Store kind to migrate to (redis|memory|fs|bolt)")
+	f.Bool("dry-run", false, "List the keys --migrate-store would copy without writing them")
 	f.Parse(os.Args[1:])
 
 	// Display version.
@@ -78,28 +91,25 @@ func loadConfig() {
 	// Generate new config.
 	if ok, _ := f.GetBool("new-config"); ok {
 		if err := newConfigFile(); err != nil {
-			logger.Println(err)
-			os.Exit(1)
+			logger.Fatal(err)
 		}
-		logger.Println("generated config.toml. Edit and run the app.")
+		logger.Printf("generated config.toml. Edit and run the app.")
 		os.Exit(0)
 	}
 
 	// Generate new unit.
 	if ok, _ := f.GetBool("new-unit"); ok {
 		if err := newUnitFile(); err != nil {
-			logger.Println(err)
-			os.Exit(1)
+			logger.Fatal(err)
 		}
-		logger.Println("generated niltalk.service. Edit and install the service.")
+		logger.Printf("generated niltalk.service. Edit and install the service.")
 		os.Exit(0)
 	}
 
 	// Exctrat assets.
 	if ok, _ := f.GetBool("extract-themes"); ok {
 		if err := extractThemes(); err != nil {
-			logger.Println(err)
-			os.Exit(1)
+			logger.Fatal(err)
 		}
 		cwd, _ := os.Getwd()
 		logger.Printf("Assets extracted to %v/static/themes", cwd)
@@ -108,16 +118,36 @@ func loadConfig() {
 
 	// Read the config files.
 	cFiles, _ := f.GetStringSlice("config")
+	if err := readConfig(ko, cFiles); err != nil {
+		logger.Fatal(err)
+	}
+
+	// Merge command line flags into config.
+	ko.Load(posflag.Provider(f, ".", ko), nil)
+
+	// Apply the logging configuration.
+	var logCfg logging.Config
+	if err := ko.Unmarshal("log", &logCfg); err != nil {
+		logger.Fatalf("error unmarshalling 'log' config: %v", err)
+	}
+	if err := logger.Configure(logCfg); err != nil {
+		logger.Fatalf("invalid 'log' config: %v", err)
+	}
+}
+
+// readConfig loads the config files, or the embedded default configuration
+// if there are none, then the environment variables into k.
+func readConfig(k *koanf.Koanf, cFiles []string) error {
 	for _, f := range cFiles {
 		if _, err := os.Stat(f); len(cFiles) == 1 && f == "config.toml" && os.IsNotExist(err) {
 			continue
 		}
 		logger.Printf("reading config: %s", f)
-		if err := ko.Load(file.Provider(f), toml.Parser()); err != nil {
+		if err := k.Load(file.Provider(f), toml.Parser()); err != nil {
 			if os.IsNotExist(err) {
-				logger.Fatal("config file not found. If there isn't one yet, run --new-config to generate one.")
+				return errors.New("config file not found. If there isn't one yet, run --new-config to generate one.")
 			}
-			logger.Fatalf("error loading config from file: %v.", err)
+			return fmt.Errorf("error loading config from file: %v.", err)
 		}
 	}
 
@@ -127,24 +157,22 @@ func loadConfig() {
 		sampleBox := rice.MustFindBox("static/samples")
 		b, err := sampleBox.Bytes("config.toml")
 		if err != nil {
-			logger.Fatalf("error reading embedded asset %q: %v.", "static/samples/config.toml", err)
+			return fmt.Errorf("error reading embedded asset %q: %v.", "static/samples/config.toml", err)
 		}
-		err = ko.Load(rawbytes.Provider(b), toml.Parser())
+		err = k.Load(rawbytes.Provider(b), toml.Parser())
 		if err != nil {
-			logger.Fatalf("error loading default configuration file: %v.", err)
+			return fmt.Errorf("error loading default configuration file: %v.", err)
 		}
 	}
 
 	// Merge env flags into config.
-	if err := ko.Load(env.Provider("NILTALK_", ".", func(s string) string {
+	if err := k.Load(env.Provider("NILTALK_", ".", func(s string) string {
 		return strings.Replace(strings.ToLower(
 			strings.TrimPrefix(s, "NILTALK_")), "__", ".", -1)
 	}), nil); err != nil {
 		logger.Printf("error loading env config: %v", err)
 	}
-
-	// Merge command line flags into config.
-	ko.Load(posflag.Provider(f, ".", ko), nil)
+	return nil
 }
 
 func main() {
@@ -167,7 +195,7 @@ func main() {
 		logger.Fatalf("error unmarshalling 'app' config: %v", err)
 	}
 	if app.cfg.Theme == "" {
-		logger.Println("configuration directive 'app.theme' is empty, setting default to 'knadh'")
+		logger.Printf("configuration directive 'app.theme' is empty, setting default to 'knadh'")
 		app.cfg.Theme = "knadh"
 	}
 
@@ -181,6 +209,22 @@ func main() {
 		logger.Fatal("app.websocket_timeout and app.roomage should be > 3s")
 	}
 
+	if ko.Bool("rotate-store-key") {
+		n, err := app.rotateStoreKey(ko.String("new-store-key-file"))
+		if err != nil {
+			logger.Fatalf("could not rotate the store encryption key: %v", err)
+		}
+		logger.Printf("re-encrypted %v store entries. Update the store encryption key and restart the app.", n)
+		return
+	}
+
+	if ko.Bool("migrate-store") {
+		if err := app.migrateStore(ko.String("from"), ko.String("to"), ko.Bool("dry-run")); err != nil {
+			logger.Fatalf("could not migrate the store: %v", err)
+		}
+		return
+	}
+
 	// Initialize store.
 	store, err := app.makeStore()
 	if err != nil {
@@ -214,24 +258,26 @@ func main() {
 		return // to allow for defers to execute
 	}
 
-	app.hub = hub.NewHub(app.cfg /*, store*/, logger)
+	app.hub = hub.NewHub(app.cfg, store, logger)
 
-	if err := ko.Unmarshal("rooms", &app.cfg.Rooms); err != nil {
-		logger.Fatalf("error unmarshalling 'rooms' config: %v", err)
+	var rcCfg roomCreationCfg
+	if err := ko.Unmarshal("room_creation", &rcCfg); err != nil {
+		logger.Fatalf("error unmarshalling 'room_creation' config: %v", err)
 	}
-	// setup predefined rooms
-	err = app.loadPredefinedRooms(themesBox)
+	app.roomLimiter, err = newRoomCreationLimiter(rcCfg)
 	if err != nil {
-		logger.Fatalf("error loading predefined rooms: %v", err)
+		logger.Fatalf("invalid 'room_creation' config: %v", err)
 	}
 
-	// Compile static templates.
-	tpls, err := app.buildTpls()
-	if err != nil {
-		logger.Fatalf("error compiling templates: %v", err)
+	var clusterCfg clusterCfg
+	if err := ko.Unmarshal("cluster", &clusterCfg); err != nil {
+		logger.Fatalf("error unmarshalling 'cluster' config: %v", err)
+	}
+	if clusterCfg.Enabled {
+		if err := app.joinCluster(clusterCfg); err != nil {
+			logger.Fatalf("error joining the cluster: %v", err)
+		}
 	}
-	app.jit = ko.Bool("jit")
-	app.tpls = tpls
 
 	// Setup the file upload store.
 	var uploadCfg upload.Config
@@ -239,10 +285,23 @@ func main() {
 		logger.Fatalf("error unmarshalling 'upload' config: %v", err)
 	}
 
-	uploadStore := upload.New(uploadCfg)
-	if err := uploadStore.Init(); err != nil {
-		logger.Fatalf("error initializing upload store: %v", err)
+	uploadStore := upload.New(uploadCfg, logger.Std())
+
+	if err := ko.Unmarshal("rooms", &app.cfg.Rooms); err != nil {
+		logger.Fatalf("error unmarshalling 'rooms' config: %v", err)
+	}
+	// setup the rooms and their files.
+	if err := app.loadRooms(uploadStore, themesBox); err != nil {
+		logger.Fatal(err)
+	}
+
+	// Compile static templates.
+	tpls, err := app.buildTpls()
+	if err != nil {
+		logger.Fatalf("error compiling templates: %v", err)
 	}
+	app.jit = ko.Bool("jit")
+	app.tpls = tpls
 
 	// Register HTTP routes.
 	r := chi.NewRouter()
@@ -250,16 +309,63 @@ func main() {
 	r.Get("/r/{roomID}/ws", wrap(handleWS, app, hasAuth|hasRoom))
 
 	// API.
+	r.Get("/api/rooms/challenge", wrap(handleRoomChallenge, app, 0))
 	r.Post("/api/rooms", wrap(handleCreateRoom, app, 0))
 	r.Post("/r/{roomID}/login", wrap(handleLogin, app, hasRoom))
 	r.Delete("/r/{roomID}/login", wrap(handleLogout, app, hasAuth|hasRoom))
 
-	r.Post("/r/{roomID}/upload", handleUpload(uploadStore))
-	r.Get("/r/{roomID}/uploaded/{fileID}", handleUploaded(uploadStore))
+	r.Post("/r/{roomID}/uploads", wrap(handleUploadCreate(uploadStore), app, hasAuth|hasRoom))
+	r.Head("/r/{roomID}/uploads/{uploadID}", wrap(handleUploadStatus(uploadStore), app, hasAuth|hasRoom))
+	r.Patch("/r/{roomID}/uploads/{uploadID}", wrap(handleUploadChunk(uploadStore), app, hasAuth|hasRoom))
+	r.Post("/r/{roomID}/uploads/{uploadID}/finalize", wrap(handleUploadFinalize(uploadStore), app, hasAuth|hasRoom))
+	r.Delete("/r/{roomID}/uploads/{uploadID}", wrap(handleUploadAbort(uploadStore), app, hasAuth|hasRoom))
+	r.Get("/r/{roomID}/uploaded/{fileID}", wrap(handleUploaded(uploadStore), app, hasAuth|hasRoom))
 
 	// Views.
 	r.Get("/r/{roomID}", wrap(handleRoomPage, app, hasAuth|hasRoom))
 
+	// Routes served on the clear listeners only, the onion service
+	// serves r.
+	cr := chi.NewRouter()
+
+	// Operators API and dashboard.
+	var adminCfg adminCfg
+	if err := ko.Unmarshal("admin", &adminCfg); err != nil {
+		logger.Fatalf("error unmarshalling 'admin' config: %v", err)
+	}
+	var asrv *http.Server
+	if adminCfg.Enabled {
+		if err := validateAdminCfg(adminCfg); err != nil {
+			logger.Fatalf("invalid 'admin' config: %v", err)
+		}
+		if adminCfg.Address == "" {
+			cr.Mount("/admin", app.adminRouter(adminCfg))
+		} else {
+			ar := chi.NewRouter()
+			ar.Mount("/admin", app.adminRouter(adminCfg))
+			if asrv, err = serveAdmin(adminCfg, ar); err != nil {
+				logger.Fatalf("couldn't start the admin server: %v", err)
+			}
+		}
+	}
+
+	// Prometheus metrics.
+	var metricsCfg metricsCfg
+	if err := ko.Unmarshal("metrics", &metricsCfg); err != nil {
+		logger.Fatalf("error unmarshalling 'metrics' config: %v", err)
+	}
+	var msrv *http.Server
+	if metricsCfg.Enabled {
+		if err := validateMetricsCfg(metricsCfg, adminCfg); err != nil {
+			logger.Fatalf("invalid 'metrics' config: %v", err)
+		}
+		if metricsCfg.Address == "" {
+			cr.With(adminAuth(adminCfg)).Get("/metrics", metrics.Handler().ServeHTTP)
+		} else if msrv, err = serveMetrics(metricsCfg); err != nil {
+			logger.Fatalf("couldn't start the metrics server: %v", err)
+		}
+	}
+
 	// QRCode.
 	if err := ko.Unmarshal("qr", &app.qrConfig); err != nil {
 		logger.Fatalf("error unmarshalling 'qr' config: %v", err)
@@ -282,32 +388,33 @@ func main() {
 	// Assets.
 	assets := http.StripPrefix("/static/", http.FileServer(themesBox.HTTPBox()))
 	r.Get("/static/*", noDirListHandler(assets.ServeHTTP))
+	cr.Handle("/*", r)
 
 	// Start the app.
+	var tsrv *torServer
 	if torCfg.Enabled {
 		pk, err := loadTorPK(torCfg, store)
 		if err != nil {
 			logger.Fatalf("could not read or write the private key: %v", err)
 		}
 
-		srv := &torServer{
+		tsrv = &torServer{
 			PrivateKey: pk,
-			Handler:    r,
+			Handler:    torHandler(r),
 		}
-		defer srv.Close()
 
 		onionAddr := onionAddr(pk) + ".onion"
 
 		logger.Printf("starting hidden service on http://%v", onionAddr)
 		go func() {
-			if err := srv.Serve(ln); err != nil {
+			if err := tsrv.Serve(ln); err != nil && err != http.ErrServerClosed {
 				logger.Fatalf("couldn't serve: %v", err)
 			}
 		}()
 	}
 
 	srv := http.Server{
-		Handler: r,
+		Handler: cr,
 	}
 	var sslCfg sslCfg
 	if err := ko.Unmarshal("ssl", &sslCfg); err != nil {
@@ -359,18 +466,19 @@ func main() {
 
 	logger.Printf("starting server on http://%v", ln.Addr().String())
 	go func() {
-		if err := srv.Serve(ln); err != nil {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
 			logger.Fatalf("couldn't serve: %v", err)
 		}
 	}()
 
+	var ssrv *http.Server
 	if sslCfg.Enabled {
 		sln, err := net.Listen("tcp", sslAddr)
 		if err != nil {
 			logger.Fatalf("couldn't listen address %q: %v", sslAddr, err)
 		}
-		ssrv := http.Server{
-			Handler: r,
+		ssrv = &http.Server{
+			Handler: cr,
 		}
 		if sslCfg.Kind == "auto" {
 			ssrv.TLSConfig = tlsConfig(getCertificate(sslCfg.Domains))
@@ -393,7 +501,7 @@ func main() {
 			} else {
 				err = ssrv.ServeTLS(sln, "", "")
 			}
-			if err != nil {
+			if err != nil && err != http.ErrServerClosed {
 				logger.Fatalf("couldn't tls serve: %v", err)
 			}
 		}()
@@ -403,17 +511,60 @@ func main() {
 	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
 	var cFiles []string
 	ko.Unmarshal("config", &cFiles)
-	select {
-	case <-fileWatcher(cFiles...):
-	case sig := <-c:
-		logger.Printf("shutting down: %v", sig)
+
+	// Reload the configuration when the files change, until a signal is received.
+	changed := fileWatcher(cFiles...)
+	var sig os.Signal
+	for sig == nil {
+		select {
+		case <-changed:
+			if err := app.reloadConfig(cFiles); err != nil {
+				logger.Printf("error reloading the configuration, keeping the current one: %v", err)
+			}
+		case sig = <-c:
+		}
 	}
+	logger.Printf("shutting down: %v", sig)
+	// The shutdown is given d to complete, the store flushed once the
+	// context expired gets a margin before quitting anyway.
+	d := time.Second * 10
 	go func() {
-		d := time.Second * 10
-		<-time.After(d)
-		logger.Printf("%v elapsed... quitting now", d)
+		hard := d + time.Second*5
+		<-time.After(hard)
+		logger.Printf("%v elapsed... quitting now", hard)
 		os.Exit(1)
 	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	app.shutdown(ctx, []*http.Server{&srv, ssrv, asrv, msrv}, tsrv, store, uploadStore)
+}
+
+// shutdown stops accepting connections, notifies the peers that the server
+// is restarting and disconnects them, then closes the onion service and
+// flushes the store. The uploads in progress are discarded.
+func (a *App) shutdown(ctx context.Context, servers []*http.Server, tsrv *torServer, s store.Store, uploads *upload.Store) {
+	for _, srv := range servers {
+		if srv == nil {
+			continue
+		}
+		if err := srv.Shutdown(ctx); err != nil {
+			logger.Printf("error shutting down the server: %v", err)
+		}
+	}
+	if err := a.hub.Shutdown(ctx); err != nil {
+		logger.Printf("error shutting down the rooms: %v", err)
+	}
+	if tsrv != nil {
+		if err := tsrv.Shutdown(ctx); err != nil {
+			logger.Printf("error shutting down the hidden service: %v", err)
+		}
+	}
+	closeStore(s)
+	if err := uploads.Close(); err != nil {
+		logger.Printf("error closing the upload store: %v", err)
+	}
+	logger.Printf("shutdown complete")
 }
 
 func fileWatcher(files ...string) chan struct{} {
@@ -431,16 +582,25 @@ func fileWatcher(files ...string) chan struct{} {
 			}
 		}
 		go func() {
+			// Editors write files in several steps, wait for them to settle.
+			var settled <-chan time.Time
 			for {
 				select {
 				case event, ok := <-watcher.Events:
 					if !ok {
 						return
 					}
-					// if event.Op&fsnotify.Write == fsnotify.Write {
 					logger.Printf("configuration file %q was modified", event.Name)
+					// The file may have been replaced, watch the new one.
+					if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+						if err := watcher.Add(event.Name); err != nil {
+							logger.Printf("failed to add configuration file %q watcher: %v", event.Name, err)
+						}
+					}
+					settled = time.After(time.Second)
+				case <-settled:
+					settled = nil
 					out <- struct{}{}
-					// }
 				case err, ok := <-watcher.Errors:
 					if !ok {
 						return
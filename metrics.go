@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/knadh/niltalk/internal/metrics"
+)
+
+// metricsCfg represents the Prometheus metrics configuration.
+type metricsCfg struct {
+	Enabled bool `koanf:"enabled"`
+	// Address of a separate listener, the app one is used when empty,
+	// behind the admin token.
+	Address string `koanf:"address"`
+}
+
+// serveMetrics serves the metrics on their own listener.
+func serveMetrics(cfg metricsCfg) (*http.Server, error) {
+	ln, err := net.Listen("tcp", cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	srv := &http.Server{Handler: mux}
+
+	logger.Printf("starting metrics server on http://%v/metrics", ln.Addr().String())
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			logger.Fatalf("couldn't serve metrics: %v", err)
+		}
+	}()
+	return srv, nil
+}
+
+// validateMetricsCfg checks that the metrics can not be reached without
+// authentication on the app listener.
+func validateMetricsCfg(cfg metricsCfg, admin adminCfg) error {
+	if cfg.Address == "" && (!admin.Enabled || admin.Token == "") {
+		return errors.New("metrics.address is required unless admin.token is set to authenticate them on the app listener")
+	}
+	return nil
+}
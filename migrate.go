@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/knadh/niltalk/store"
+)
+
+// migration is an entry to copy from a store to another.
+type migration struct {
+	key  string
+	data []byte
+	ttl  time.Duration
+}
+
+// migrateStore copies every key of the from store kind to the to store kind.
+// Backends are configured by the [migrate.from] and [migrate.to] sections,
+// or by [store] when absent. Values are copied as is, so encrypted stores
+// remain readable with the same key. When dryRun is true, the keys to move
+// are only listed.
+func (a *App) migrateStore(from, to string, dryRun bool) error {
+	if from == "" || to == "" {
+		return fmt.Errorf("--from and --to are required")
+	}
+	src, err := a.makeBackend(from, migrateCfgKey("from"))
+	if err != nil {
+		return err
+	}
+	defer closeStore(src)
+
+	entries, size, err := readEntries(src)
+	if err != nil {
+		return fmt.Errorf("error listing the %v store: %v", from, err)
+	}
+
+	if dryRun {
+		for _, m := range entries {
+			if m.ttl > 0 {
+				fmt.Printf("%v\t%v bytes\texpires in %v\n", m.key, len(m.data), m.ttl.Round(time.Second))
+			} else {
+				fmt.Printf("%v\t%v bytes\n", m.key, len(m.data))
+			}
+		}
+		logger.Printf("dry run: %v keys (%v bytes) would be copied from %v to %v", len(entries), size, from, to)
+		return nil
+	}
+
+	dst, err := a.makeBackend(to, migrateCfgKey("to"))
+	if err != nil {
+		return err
+	}
+	defer closeStore(dst)
+
+	if err := copyEntries(dst, entries); err != nil {
+		return fmt.Errorf("error copying to the %v store: %v", to, err)
+	}
+	logger.Printf("copied %v keys (%v bytes) from %v to %v", len(entries), size, from, to)
+	return nil
+}
+
+// readEntries returns the entries of the store src with their expiries,
+// and their total size. The expiries are read once the keys are listed as
+// the stores lock their data while iterating.
+func readEntries(src store.Store) ([]migration, int, error) {
+	it, ok := src.(store.Iterator)
+	if !ok {
+		return nil, 0, errors.New("the store cannot list its keys")
+	}
+
+	var entries []migration
+	err := it.Iterate("", func(key string, data []byte) error {
+		entries = append(entries, migration{key: key, data: data})
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var (
+		ttlr, _ = src.(store.TTLReader)
+		out     = entries[:0]
+		size    int
+	)
+	for _, m := range entries {
+		if ttlr != nil {
+			ttl, err := ttlr.TTL(m.key)
+			if err != nil {
+				// The key expired in the meantime.
+				continue
+			}
+			m.ttl = ttl
+		}
+		out = append(out, m)
+		size += len(m.data)
+	}
+	return out, size, nil
+}
+
+// copyEntries writes the entries to the store dst with their expiries.
+func copyEntries(dst store.Store, entries []migration) error {
+	for _, m := range entries {
+		var err error
+		if m.ttl > 0 {
+			err = dst.SetWithTTL(m.key, m.data, m.ttl)
+		} else {
+			err = dst.Set(m.key, m.data)
+		}
+		if err != nil {
+			return fmt.Errorf("error copying %q: %v", m.key, err)
+		}
+	}
+	return nil
+}
+
+// migrateCfgKey returns the config key of a migration side.
+func migrateCfgKey(side string) string {
+	if k := "migrate." + side; ko.Exists(k) {
+		return k
+	}
+	return "store"
+}
+
+// closeStore closes the store if it holds resources.
+func closeStore(s store.Store) {
+	if c, ok := s.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			logger.Printf("error closing the store: %v", err)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/knadh/niltalk/store/fs"
+	"github.com/knadh/niltalk/store/mem"
+)
+
+func TestMigrateFsToMem(t *testing.T) {
+	dir, err := ioutil.TempDir("", "niltalk-migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src, err := fs.New(fs.Config{Path: filepath.Join(dir, "db.json")}, log.New(ioutil.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	if err := src.Set("ROOM:a", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.SetWithTTL("SESS:b", []byte("b"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := mem.New(mem.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reading the expiries while iterating used to deadlock.
+	done := make(chan error, 1)
+	go func() {
+		entries, size, err := readEntries(src)
+		if err == nil && (len(entries) != 2 || size != 2) {
+			t.Errorf("got %v entries of %v bytes, want 2 of 2 bytes", len(entries), size)
+		}
+		if err == nil {
+			err = copyEntries(dst, entries)
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("migration did not complete")
+	}
+
+	for _, k := range []string{"ROOM:a", "SESS:b"} {
+		if _, err := dst.Get(k); err != nil {
+			t.Errorf("key %q not copied: %v", k, err)
+		}
+	}
+	if ttl, err := dst.TTL("ROOM:a"); err != nil || ttl != 0 {
+		t.Errorf("ROOM:a: got ttl %v (%v), want no expiry", ttl, err)
+	}
+	if ttl, err := dst.TTL("SESS:b"); err != nil || ttl <= 0 || ttl > time.Hour {
+		t.Errorf("SESS:b: got ttl %v (%v), want up to an hour", ttl, err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/knadh/koanf"
+	"github.com/knadh/niltalk/internal/hub"
+	"github.com/knadh/niltalk/internal/logging"
+)
+
+// reloadConfig re-reads the configuration files and applies the 'app' and
+// 'rooms' settings without a restart: predefined rooms are added, removed or
+// updated, the theme and the rate limits are swapped, and the growl notifiers
+// are set up again. Active rooms and connections are kept. An invalid
+// configuration is rejected as a whole and the current one is kept.
+func (a *App) reloadConfig(cFiles []string) error {
+	k := koanf.New(".")
+	if err := readConfig(k, cFiles); err != nil {
+		return err
+	}
+
+	cfg := &hub.Config{}
+	if err := k.Unmarshal("app", cfg); err != nil {
+		return fmt.Errorf("error unmarshalling 'app' config: %v", err)
+	}
+	if err := k.Unmarshal("rooms", &cfg.Rooms); err != nil {
+		return fmt.Errorf("error unmarshalling 'rooms' config: %v", err)
+	}
+	if cfg.Theme == "" {
+		cfg.Theme = "knadh"
+	}
+	if err := a.validateConfig(cfg); err != nil {
+		return err
+	}
+
+	// The listener and the store are set up once at startup.
+	old := a.hub.Config()
+	if cfg.Address != old.Address || cfg.Storage != old.Storage {
+		logger.Printf("app.address and app.storage changes require a restart")
+		cfg.Address, cfg.Storage = old.Address, old.Storage
+	}
+
+	var logCfg logging.Config
+	if err := k.Unmarshal("log", &logCfg); err != nil {
+		return fmt.Errorf("error unmarshalling 'log' config: %v", err)
+	}
+	if err := logger.Configure(logCfg); err != nil {
+		return fmt.Errorf("invalid 'log' config: %v", err)
+	}
+
+	a.hub.SetConfig(cfg)
+	a.reloadPredefinedRooms(old.Rooms, cfg.Rooms)
+	logger.Printf("configuration reloaded")
+	return nil
+}
+
+// validateConfig checks a reloaded configuration before it is applied.
+func (a *App) validateConfig(cfg *hub.Config) error {
+	minTime := time.Duration(3) * time.Second
+	if cfg.RoomAge < minTime || cfg.WSTimeout < minTime {
+		return errors.New("app.websocket_timeout and app.roomage should be > 3s")
+	}
+
+	if a.jit {
+		if _, err := a.buildTheme(cfg.Theme); err != nil {
+			return fmt.Errorf("error compiling theme %q: %v", cfg.Theme, err)
+		}
+	} else if _, ok := a.tpls[cfg.Theme]; !ok {
+		return fmt.Errorf("theme %q not found", cfg.Theme)
+	}
+
+	if err := checkPredefinedIDs(cfg.Rooms); err != nil {
+		return err
+	}
+	for key, room := range cfg.Rooms {
+		if room.ID == "" {
+			return fmt.Errorf("predefined room %q has no id", key)
+		}
+		for _, u := range room.Users {
+			if u.Owner && u.Password == "" {
+				return fmt.Errorf("owner user %q of room %q must have a password", u.Name, room.ID)
+			}
+		}
+	}
+	return nil
+}
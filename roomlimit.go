@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/bits"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// powTTL is how long a proof of work challenge can be solved for.
+const powTTL = time.Minute * 5
+
+var (
+	errCreationRateLimited = errors.New("too many rooms created, try again later")
+	errInvalidPow          = errors.New("invalid or expired proof of work, try again")
+)
+
+// roomCreationCfg represents the limits of the ad-hoc room creation.
+type roomCreationCfg struct {
+	// Rooms a client can create per period, 0 disables the limit.
+	RlCount  int           `koanf:"rate_limit_count"`
+	RlPeriod time.Duration `koanf:"rate_limit_period"`
+	RlBurst  int           `koanf:"rate_limit_burst"`
+	// Rooms all the hidden service clients can create per period.
+	TorRlCount  int           `koanf:"tor_rate_limit_count"`
+	TorRlPeriod time.Duration `koanf:"tor_rate_limit_period"`
+	TorRlBurst  int           `koanf:"tor_rate_limit_burst"`
+	// RealIPHeader is set by a trusted reverse proxy with the client address.
+	RealIPHeader string `koanf:"real_ip_header"`
+	// PowDifficulty is the number of leading zero bits of the proof of
+	// work hash, 0 disables it.
+	PowDifficulty int `koanf:"pow_difficulty"`
+}
+
+type ctxKey int
+
+// ctxTor marks the requests received by the hidden service.
+const ctxTor ctxKey = iota
+
+// torHandler marks the requests served by the hidden service, which all
+// come from the local tor process and can not be told apart by address.
+func torHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxTor, true)))
+	})
+}
+
+// clientLimiter is the creation rate limiter of a client.
+type clientLimiter struct {
+	limiter *rate.Limiter
+	expire  time.Time
+}
+
+// roomCreationLimiter rate limits the room creation per client address,
+// with a single limiter shared by the hidden service clients, and checks
+// the proof of work of the requests.
+type roomCreationLimiter struct {
+	cfg roomCreationCfg
+	tor *rate.Limiter
+
+	mu      sync.Mutex
+	clients map[string]clientLimiter
+	// used holds the solved challenges until they expire, so that
+	// a solution can not be replayed.
+	used map[string]time.Time
+
+	// powKey signs the challenges, which are then not stored until solved.
+	powKey []byte
+}
+
+func newRoomCreationLimiter(cfg roomCreationCfg) (*roomCreationLimiter, error) {
+	if (cfg.RlCount > 0 && cfg.RlPeriod <= 0) || (cfg.TorRlCount > 0 && cfg.TorRlPeriod <= 0) {
+		return nil, errors.New("room_creation rate limit periods should be > 0")
+	}
+	// A burst of 0 would not allow any room to be created.
+	if (cfg.RlCount > 0 && cfg.RlBurst < 1) || (cfg.TorRlCount > 0 && cfg.TorRlBurst < 1) {
+		return nil, errors.New("room_creation rate limit bursts should be >= 1")
+	}
+	if cfg.PowDifficulty < 0 || cfg.PowDifficulty > 32 {
+		return nil, errors.New("room_creation.pow_difficulty should be between 0 and 32")
+	}
+
+	l := &roomCreationLimiter{
+		cfg:     cfg,
+		clients: map[string]clientLimiter{},
+		used:    map[string]time.Time{},
+		powKey:  make([]byte, 32),
+	}
+	if _, err := rand.Read(l.powKey); err != nil {
+		return nil, err
+	}
+	if cfg.TorRlCount > 0 {
+		l.tor = rate.NewLimiter(rate.Every(cfg.TorRlPeriod/time.Duration(cfg.TorRlCount)), cfg.TorRlBurst)
+	}
+	go l.cleanup()
+	return l, nil
+}
+
+// allow reports whether the client of the request can create a room.
+func (l *roomCreationLimiter) allow(r *http.Request) bool {
+	if r.Context().Value(ctxTor) != nil {
+		return l.tor == nil || l.tor.Allow()
+	}
+	if l.cfg.RlCount <= 0 {
+		return true
+	}
+
+	addr := l.clientAddr(r)
+	l.mu.Lock()
+	x, ok := l.clients[addr]
+	if !ok {
+		x.limiter = rate.NewLimiter(rate.Every(l.cfg.RlPeriod/time.Duration(l.cfg.RlCount)), l.cfg.RlBurst)
+	}
+	x.expire = time.Now().Add(l.cfg.RlPeriod)
+	l.clients[addr] = x
+	l.mu.Unlock()
+	return x.limiter.Allow()
+}
+
+// clientAddr returns the address the client is rate limited by. IPv6
+// clients are limited by their /64 network, which they usually own whole.
+func (l *roomCreationLimiter) clientAddr(r *http.Request) string {
+	addr := r.RemoteAddr
+	if l.cfg.RealIPHeader != "" {
+		// Proxies append the address they got the request from,
+		// the last one is set by the trusted proxy.
+		if v := r.Header.Get(l.cfg.RealIPHeader); v != "" {
+			parts := strings.Split(v, ",")
+			addr = strings.TrimSpace(parts[len(parts)-1])
+		}
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return addr
+	}
+	if ip.To4() == nil {
+		return ip.Mask(net.CIDRMask(64, 128)).String()
+	}
+	return ip.String()
+}
+
+// challenge returns a new proof of work challenge: its creation time and
+// a random value, signed with the key of the limiter.
+func (l *roomCreationLimiter) challenge() (string, error) {
+	b := make([]byte, 24)
+	binary.BigEndian.PutUint64(b, uint64(time.Now().Unix()))
+	if _, err := rand.Read(b[8:]); err != nil {
+		return "", err
+	}
+	c := hex.EncodeToString(b)
+	return c + "." + l.sign(c), nil
+}
+
+func (l *roomCreationLimiter) sign(c string) string {
+	h := hmac.New(sha256.New, l.powKey)
+	h.Write([]byte(c))
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// checkPow verifies that the SHA-256 hash of "challenge:nonce" starts with
+// the configured number of zero bits, for a challenge that was issued by
+// the limiter, did not expire, and was not solved before.
+func (l *roomCreationLimiter) checkPow(challenge, nonce string) error {
+	if l.cfg.PowDifficulty == 0 {
+		return nil
+	}
+
+	parts := strings.Split(challenge, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(l.sign(parts[0])), []byte(parts[1])) {
+		return errInvalidPow
+	}
+	b, err := hex.DecodeString(parts[0])
+	if err != nil || len(b) != 24 {
+		return errInvalidPow
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint64(b)), 0)
+	if time.Since(issued) > powTTL {
+		return errInvalidPow
+	}
+
+	sum := sha256.Sum256([]byte(challenge + ":" + nonce))
+	if leadingZeroBits(sum[:]) < l.cfg.PowDifficulty {
+		return errInvalidPow
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.used[challenge]; ok {
+		return errInvalidPow
+	}
+	l.used[challenge] = issued.Add(powTTL)
+	return nil
+}
+
+func leadingZeroBits(b []byte) int {
+	n := 0
+	for _, c := range b {
+		if c != 0 {
+			return n + bits.LeadingZeros8(c)
+		}
+		n += 8
+	}
+	return n
+}
+
+// cleanup periodically removes the expired client limiters and challenges.
+func (l *roomCreationLimiter) cleanup() {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for range t.C {
+		now := time.Now()
+		l.mu.Lock()
+		for k, c := range l.clients {
+			if c.expire.Before(now) {
+				delete(l.clients, k)
+			}
+		}
+		for k, exp := range l.used {
+			if exp.Before(now) {
+				delete(l.used, k)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
@@ -1,39 +1,160 @@
 package main
 
 import (
+	"fmt"
+	"reflect"
+
 	rice "github.com/GeertJohan/go.rice"
 	"github.com/knadh/niltalk/internal/hub"
+	"github.com/knadh/niltalk/internal/logging"
 	"github.com/knadh/niltalk/internal/notify"
+	"github.com/knadh/niltalk/internal/upload"
 )
 
+// loadRooms restores the persisted rooms, creates the predefined ones
+// and loads the files shared in them. The files of the rooms that do not
+// exist are expired when the upload store is initialized, so all the
+// rooms are registered first. The cluster must be joined before.
+func (a *App) loadRooms(uploads *upload.Store, assetBox *rice.Box) error {
+	// The files of the rooms gone while the server was down are expired.
+	// They are kept if the store can not tell.
+	uploads.RoomExists = func(id string) bool {
+		ok, err := a.hub.RoomExists(id)
+		if err != nil {
+			a.logger.Warn("error checking room", "room", logging.ID(id), "err", err)
+			return true
+		}
+		return ok
+	}
+	// The files of a room are deleted along with it.
+	a.hub.OnDispose(uploads.DeleteRoom)
+
+	// Restore the rooms once the cluster and the hooks are set up, their
+	// loops use them.
+	a.hub.LoadRooms()
+	if err := a.loadPredefinedRooms(assetBox); err != nil {
+		return fmt.Errorf("error loading predefined rooms: %v", err)
+	}
+	if err := uploads.Init(); err != nil {
+		return fmt.Errorf("error initializing upload store: %v", err)
+	}
+	return nil
+}
+
 // loadPredefinedRooms loads into curet hub the given list of predefind rooms.
 // It must be called before starting the app and is not safe for concurrent use.
 func (a *App) loadPredefinedRooms(assetBox *rice.Box) error {
 	rooms := a.cfg.Rooms
-	localURL := "http://" + a.localAddress
+	if err := checkPredefinedIDs(rooms); err != nil {
+		return err
+	}
 	for _, room := range rooms {
-		r, err := a.hub.AddPredefinedRoom(room.ID, room.Name)
-		if err != nil {
-			a.logger.Printf("error creating a predefined room %q: %v", room.Name, err)
+		if err := a.addPredefinedRoom(room, assetBox); err != nil {
+			a.logger.Error("error loading predefined room", "err", err)
+		}
+	}
+	return nil
+}
+
+// addPredefinedRoom creates a predefined room and sets up its users
+// and growl notifications.
+func (a *App) addPredefinedRoom(room hub.PredefinedRoom, assetBox *rice.Box) error {
+	r, err := a.hub.AddPredefinedRoom(room.ID, room.Name, room.Password)
+	if err != nil {
+		return fmt.Errorf("error creating a predefined room %q: %v", room.Name, err)
+	}
+	if err := r.SetPredefinedUsers(room.Users); err != nil {
+		return fmt.Errorf("error setting up the users of the predefined room %q: %v", room.Name, err)
+	}
+	return a.setupGrowl(r, room, assetBox)
+}
+
+// setupGrowl sets the growl notifier of a predefined room if any of its
+// users is notified, and removes it otherwise.
+func (a *App) setupGrowl(r *hub.Room, room hub.PredefinedRoom, assetBox *rice.Box) error {
+	var growl bool
+	for _, u := range room.Users {
+		if u.Growl {
+			growl = true
+			break
+		}
+	}
+	if !growl {
+		r.SetGrowlHandler(nil)
+		return nil
+	}
+	n := notify.New(room.Growl, "http://"+a.localAddress, r.ID, a.logger, assetBox)
+	if err := n.Init(); err != nil {
+		return fmt.Errorf("error setting up growl notifications for the predefined room %q: %v", room.Name, err)
+	}
+	r.SetGrowlHandler(n.OnGrowlMessage)
+	return nil
+}
+
+// reloadPredefinedRooms applies the changes of the predefined rooms
+// between two configurations. Removed rooms are disposed of, added rooms
+// are created, and the changed ones are reconfigured with their peers
+// connected.
+func (a *App) reloadPredefinedRooms(oldCfg, newCfg map[string]hub.PredefinedRoom) {
+	old, rooms := roomsByID(oldCfg), roomsByID(newCfg)
+	for id, room := range old {
+		if _, ok := rooms[id]; ok {
 			continue
 		}
-		r.PredefinedUsers = make([]hub.PredefinedUser, len(room.Users), len(room.Users))
-		copy(r.PredefinedUsers, room.Users)
-		var growl bool
-		for _, u := range r.PredefinedUsers {
-			if u.Growl {
-				growl = true
-				break
-			}
+		if r := a.hub.GetRoom(id); r != nil {
+			a.logger.Printf("removing predefined room %q", room.Name)
+			r.ForceDispose()
 		}
-		if growl {
-			n := notify.New(room.Growl, localURL, r.ID, a.logger, assetBox)
-			if err = n.Init(); err != nil {
-				a.logger.Printf("error setting up growl notifications for the predefined room %q: %v", room.Name, err)
-				continue
+	}
+
+	for id, room := range rooms {
+		prev, ok := old[id]
+		if !ok {
+			a.logger.Printf("adding predefined room %q", room.Name)
+			if err := a.addPredefinedRoom(room, a.themesBox); err != nil {
+				a.logger.Error("error loading predefined room", "err", err)
 			}
-			r.GrowlHandler = n.OnGrowlMessage
+			continue
+		}
+		if reflect.DeepEqual(prev, room) {
+			continue
+		}
+
+		r := a.hub.GetRoom(id)
+		if r == nil {
+			continue
+		}
+		if prev.Name != room.Name || prev.PersistBacklog != room.PersistBacklog {
+			a.logger.Printf("the name and persist_backlog of predefined room %q change on restart", room.Name)
+		}
+		a.logger.Printf("updating predefined room %q", room.Name)
+		if err := r.Reconfigure(room); err != nil {
+			a.logger.Printf("error updating the predefined room %q: %v", room.Name, err)
+			continue
+		}
+		if err := a.setupGrowl(r, room, a.themesBox); err != nil {
+			a.logger.Error("error loading predefined room", "err", err)
+		}
+	}
+}
+
+// checkPredefinedIDs returns an error if predefined rooms share an ID.
+func checkPredefinedIDs(rooms map[string]hub.PredefinedRoom) error {
+	keys := make(map[string]string, len(rooms))
+	for key, r := range rooms {
+		if other, ok := keys[r.ID]; ok {
+			return fmt.Errorf("predefined rooms %q and %q have the same id %q", other, key, r.ID)
 		}
+		keys[r.ID] = key
 	}
 	return nil
 }
+
+// roomsByID indexes the predefined rooms of a configuration by room ID.
+func roomsByID(rooms map[string]hub.PredefinedRoom) map[string]hub.PredefinedRoom {
+	out := make(map[string]hub.PredefinedRoom, len(rooms))
+	for _, r := range rooms {
+		out[r.ID] = r
+	}
+	return out
+}
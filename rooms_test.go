@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/knadh/niltalk/internal/hub"
+	"github.com/knadh/niltalk/internal/logging"
+	"github.com/knadh/niltalk/internal/upload"
+	"github.com/knadh/niltalk/store/mem"
+)
+
+func TestPredefinedRoomFilesSurviveRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "niltalk-rooms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	uploadCfg := upload.Config{
+		Backend:    "disk",
+		StagingDir: filepath.Join(dir, "staging"),
+		Disk:       upload.DiskConfig{Path: filepath.Join(dir, "uploads")},
+	}
+	// start runs the app with a predefined room, on a new store as the
+	// predefined rooms are not persisted.
+	start := func() (*App, *upload.Store) {
+		st, err := mem.New(mem.Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := logging.New(ioutil.Discard)
+		cfg := &hub.Config{
+			RoomIDLen:       10,
+			WSTimeout:       time.Minute,
+			RoomAge:         time.Hour,
+			RoomTimeout:     time.Hour,
+			MaxRoomLifetime: time.Hour,
+			Rooms: map[string]hub.PredefinedRoom{
+				"lobby": {ID: "lobby", Name: "lobby"},
+			},
+		}
+		a := &App{hub: hub.NewHub(cfg, st, l), cfg: cfg, logger: l}
+		uploads := upload.New(uploadCfg, log.New(ioutil.Discard, "", 0))
+		if err := a.loadRooms(uploads, nil); err != nil {
+			t.Fatal(err)
+		}
+		return a, uploads
+	}
+
+	_, uploads := start()
+	const id = "0123456789abcdef0123456789abcdef"
+	if _, err := uploads.Add(id, "lobby", "", bytes.NewReader([]byte("sealed")), 6); err != nil {
+		t.Fatal(err)
+	}
+	uploads.Close()
+
+	_, uploads = start()
+	defer uploads.Close()
+	_, blob, err := uploads.Open("lobby", id)
+	if err != nil {
+		t.Fatalf("file of the predefined room lost on restart: %v", err)
+	}
+	blob.Close()
+}
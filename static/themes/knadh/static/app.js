@@ -25,6 +25,37 @@ Vue.component("expand-link", {
     `
 });
 
+// solvePow finds a nonce for which the SHA-256 hash of "challenge:nonce"
+// starts with difficulty zero bits. It works in batches to keep the page
+// responsive.
+function solvePow(challenge, difficulty) {
+    const zeroBits = (b) => {
+        let n = 0;
+        for (let i = 0; i < b.length; i++) {
+            if (b[i] !== 0) {
+                return n + Math.clz32(b[i]) - 24;
+            }
+            n += 8;
+        }
+        return n;
+    };
+    return new Promise((resolve) => {
+        let nonce = 0;
+        const batch = () => {
+            for (let i = 0; i < 2000; i++, nonce++) {
+                const sha = new jsSHA("SHA-256", "TEXT", { encoding: "UTF8" });
+                sha.update(challenge + ":" + nonce);
+                if (zeroBits(sha.getHash("UINT8ARRAY")) >= difficulty) {
+                    resolve(String(nonce));
+                    return;
+                }
+            }
+            setTimeout(batch, 0);
+        };
+        batch();
+    });
+}
+
 var commands = {
   "handle": {
     "help": "Change your handle",
@@ -42,6 +73,34 @@ var commands = {
     "help": "Send a message to a specific user",
     "usage": "/whisper [user] [message]",
   },
+  "ttl": {
+    "help": "Delete your next messages after some seconds, 0 for the room default",
+    "usage": "/ttl [seconds]",
+  },
+  "kick": {
+    "help": "Disconnect an user from the room (owner only)",
+    "usage": "/kick [user]",
+  },
+  "ban": {
+    "help": "Disconnect an user and prevent it from joining again (owner only)",
+    "usage": "/ban [user]",
+  },
+  "unban": {
+    "help": "Allow a banned user to join again (owner only)",
+    "usage": "/unban [user]",
+  },
+  "mute": {
+    "help": "Prevent an user from sending messages to the room (owner only)",
+    "usage": "/mute [user]",
+  },
+  "unmute": {
+    "help": "Allow a muted user to send messages again (owner only)",
+    "usage": "/unmute [user]",
+  },
+  "owner": {
+    "help": "Transfer the ownership of the room to an user (owner only)",
+    "usage": "/owner [user]",
+  },
   "help": {
     "help": "Show commands help",
     "usage": "/help [command]?",
@@ -75,8 +134,127 @@ function sortByHandle(a, b) {
   return 0;
 }
 
+// Size of the chunks of the uploads, and number of times the failed
+// chunks are resumed.
+const uploadChunkSize = 1 << 20;
+const uploadRetries = 5;
+
+// inlineTypes are the types of the shared files displayed in the room.
+const inlineTypes = ["image/png", "image/jpeg", "image/gif"];
+
+// Size of the chunks the shared files are encrypted in, each one is sealed
+// with its own nonce so that the files are encrypted and decrypted as they
+// are streamed.
+const fileChunkSize = 64 << 10;
+
+// chunkNonce returns the nonce of the chunk i of a file: the random nonce
+// of the file, the index of the chunk, and a last byte set on the final
+// chunk so that reordered or truncated files do not decrypt.
+function chunkNonce(base, i, last) {
+    const nonce = new Uint8Array(nacl.secretbox.nonceLength);
+    nonce.set(base);
+    new DataView(nonce.buffer).setUint32(16, i);
+    nonce[23] = last ? 1 : 0;
+    return nonce;
+}
+
+// sealFile returns the ciphertext of a file encrypted in chunks with key
+// and the 16 bytes nonce. It is read by ranges, only sealing the chunks
+// they cover, so that files are never loaded whole.
+function sealFile(file, key, nonce) {
+    const overhead = nacl.secretbox.overheadLength;
+    const sealedSize = fileChunkSize + overhead;
+    const count = Math.max(Math.ceil(file.size / fileChunkSize), 1);
+    return {
+        size: file.size + count * overhead,
+        // read resolves with a blob of the ciphertext from start to end.
+        read(start, end) {
+            end = Math.min(end, this.size);
+            const first = Math.floor(start / sealedSize);
+            const last = Math.floor((end - 1) / sealedSize);
+            return file.slice(first * fileChunkSize, (last + 1) * fileChunkSize).arrayBuffer().then((buf) => {
+                const parts = [];
+                for (let i = first; i <= last; i++) {
+                    const off = (i - first) * fileChunkSize;
+                    const chunk = new Uint8Array(buf, off, Math.min(fileChunkSize, buf.byteLength - off));
+                    parts.push(nacl.secretbox(chunk, chunkNonce(nonce, i, i === count - 1), key));
+                }
+                return new Blob(parts).slice(start - first * sealedSize, end - first * sealedSize);
+            });
+        },
+    };
+}
+
+// openFile downloads a file sealed with sealFile and decrypts its chunks
+// as they arrive. After a failure, the download resumes with a range
+// request from the last decrypted chunk. It resolves with the chunks of
+// plaintext.
+function openFile(url, key, nonce) {
+    const sealedSize = fileChunkSize + nacl.secretbox.overheadLength;
+    const parts = [];
+    let i = 0;
+    let complete = false;
+    let retries = 0;
+
+    const invalid = () => {
+        const err = new Error("invalid file");
+        err.invalid = true;
+        return err;
+    };
+    const download = () => fetch(url, {
+        credentials: "same-origin",
+        headers: i > 0 ? { "Range": "bytes=" + (i * sealedSize) + "-" } : {},
+    }).then((resp) => {
+        if (resp.status !== (i > 0 ? 206 : 200)) {
+            const err = new Error("Request failed with status code " + resp.status);
+            err.invalid = resp.status >= 400 && resp.status < 500;
+            throw err;
+        }
+        const reader = resp.body.getReader();
+        let buf = new Uint8Array(0);
+        const pump = () => reader.read().then(({ done, value }) => {
+            if (value) {
+                const b = new Uint8Array(buf.length + value.length);
+                b.set(buf);
+                b.set(value, buf.length);
+                buf = b;
+            }
+            // A chunk is only known to be the last one at the end of
+            // the response.
+            while (buf.length > sealedSize || (done && buf.length > 0)) {
+                const n = Math.min(sealedSize, buf.length);
+                const last = done && n === buf.length;
+                const plain = nacl.secretbox.open(buf.subarray(0, n), chunkNonce(nonce, i, last), key);
+                if (!plain) {
+                    throw invalid();
+                }
+                parts.push(plain);
+                buf = buf.slice(n);
+                i++;
+                complete = last;
+            }
+            if (!done) {
+                return pump();
+            }
+            if (!complete) {
+                throw invalid();
+            }
+            return parts;
+        });
+        return pump();
+    }).catch((err) => {
+        if (err.invalid || retries >= uploadRetries) {
+            throw err;
+        }
+        retries++;
+        return new Promise((resolve) => window.setTimeout(resolve, 1000 * retries)).then(download);
+    });
+    return download();
+}
+
 var MsgType = MsgType || {};
 MsgType.Motd = "motd";
+MsgType.Notice = "notice";
 MsgType.Error = "error";
 MsgType.Help = "help";
 MsgType.Uploading = "uploading";
@@ -88,6 +266,24 @@ MsgType.Typing = "typing";
 MsgType.RateLimited = "peer.ratelimited";
 MsgType.RoomFull = "room.full";
 MsgType.RoomDispose = "room.dispose";
+MsgType.ServerShutdown = "server.shutdown";
+MsgType.PeerKick = "peer.kick";
+MsgType.PeerBan = "peer.ban";
+MsgType.PeerUnban = "peer.unban";
+MsgType.PeerMute = "peer.mute";
+MsgType.PeerUnmute = "peer.unmute";
+MsgType.RoomOwner = "room.owner";
+MsgType.Admin = "admin";
+
+// adminCommands maps the room administration commands to their message type.
+var adminCommands = {
+  "kick": MsgType.PeerKick,
+  "ban": MsgType.PeerBan,
+  "unban": MsgType.PeerUnban,
+  "mute": MsgType.PeerMute,
+  "unmute": MsgType.PeerUnmute,
+  "owner": MsgType.RoomOwner,
+};
 
 var app = new Vue({
     el: "#app",
@@ -115,6 +311,10 @@ var app = new Vue({
 
         // Form fields.
         roomName: "",
+        burnAfter: "0",
+        roomMessageTTL: "0",
+        // Lifetime of the sent messages in seconds, 0 for the room default.
+        messageTTL: 0,
         handle: "",
         password: "",
         message: "",
@@ -153,6 +353,11 @@ var app = new Vue({
         this.whisper.on(MsgType.Typing, this.onTyping.bind(this));
         this.whisper.on(MsgType.Ping, this.onPing.bind(this));
         this.whisper.on(MsgType.Whisper, this.onWhisper.bind(this));
+        this.whisper.on(MsgType.Upload, this.onUpload.bind(this));
+        this.whisper.on(MsgType.Notice, this.onNotice.bind(this));
+        Object.values(adminCommands).map((typ) => {
+          this.whisper.on(typ, this.onAdmin.bind(this));
+        });
         //
         var url = new URL(document.location.href);
         var al = url.searchParams.get("al");
@@ -162,16 +367,31 @@ var app = new Vue({
     },
     methods: {
 
-        // Handle room creation.
+        // Handle room creation, solving the proof of work the server
+        // requires, if any.
         handleCreateRoom() {
-            fetch("/api/rooms", {
+            this.toggleBusy();
+            fetch("/api/rooms/challenge")
+            .then(resp => resp.json())
+            .then(resp => {
+                if (resp.error) {
+                    throw resp.error;
+                }
+                const c = resp.data;
+                return c.difficulty > 0 ? solvePow(c.challenge, c.difficulty).then(nonce => [c.challenge, nonce]) : ["", ""];
+            })
+            .then(([challenge, nonce]) => fetch("/api/rooms", {
                 method: "post",
                 body: JSON.stringify({
                     name: this.roomName,
-                    password: this.password
+                    password: this.password,
+                    burn_after: parseInt(this.burnAfter, 10),
+                    message_ttl: parseInt(this.roomMessageTTL, 10),
+                    pow_challenge: challenge,
+                    pow_nonce: nonce
                 }),
                 headers: { "Content-Type": "application/json; charset=utf-8" }
-            })
+            }))
             .then(resp => resp.json())
             .then(resp => {
                 this.toggleBusy();
@@ -179,6 +399,7 @@ var app = new Vue({
                 if (resp.error) {
                     this.notify(resp.error, notifType.error);
                 } else {
+                    localStorage.setItem("owner:" + resp.data.id, resp.data.owner_token);
                     document.location.replace("/r/" + resp.data.id);
                 }
             })
@@ -190,6 +411,8 @@ var app = new Vue({
 
         clearCreateRoom() {
           this.roomName = "";
+          this.burnAfter = "0";
+          this.roomMessageTTL = "0";
           this.password = "";
         },
 
@@ -215,6 +438,9 @@ var app = new Vue({
               method: "post",
               body: JSON.stringify({
                 publickey: bpub,
+                handle: handle,
+                password: password,
+                owner_token: localStorage.getItem("owner:" + _room.id) || "",
               }),
               headers: { "Content-Type": "application/json; charset=utf-8" }
           })
@@ -265,8 +491,14 @@ var app = new Vue({
           clearTimeout(this.reconnectHandle)
         },
 
-        onTransportDisconnect() {
+        onTransportDisconnect(reason) {
           this.whisper.close()
+          // The server may ask to log in again, do not retry on the others.
+          const final = [MsgType.RoomDispose, MsgType.RateLimited, MsgType.PeerKick, MsgType.PeerBan];
+          if (final.indexOf(reason) > -1) {
+            this.onDisconnect(reason)
+            return
+          }
           this.onTransportReconnecting(4000)
         },
 
@@ -286,6 +518,9 @@ var app = new Vue({
               body: JSON.stringify({
                 publickey: bpub,
                 secret: this.self.secret,
+                handle: this.self.handle,
+                password: this.self.password,
+                owner_token: localStorage.getItem("owner:" + _room.id) || "",
               }),
               headers: { "Content-Type": "application/json; charset=utf-8" }
             })
@@ -340,6 +575,16 @@ var app = new Vue({
                   this.toggleChat();
                   break;
 
+              case MsgType.PeerKick:
+                  this.notify("You were kicked from the room", notifType.error);
+                  this.toggleChat();
+                  break;
+
+              case MsgType.PeerBan:
+                  this.notify("You were banned from the room", notifType.error);
+                  this.toggleChat();
+                  break;
+
               case MsgType.RoomDispose:
                   this.notify("Room disposed", notifType.error);
                   this.toggleChat();
@@ -396,7 +641,7 @@ var app = new Vue({
               data: userMsg,
               timestamp: new Date(),
             }
-            this.whisper.broadcast(data)
+            this.whisper.broadcast(data, this.messageTTL)
             return
           }
 
@@ -428,6 +673,12 @@ var app = new Vue({
 
           }else if (commandName=="whisper"){
             this.handleWhisper(userMsg, commandName, command)
+
+          }else if (commandName=="ttl"){
+            this.handleTTL(userMsg, commandName, command)
+
+          }else if (commandName in adminCommands){
+            this.handleAdmin(userMsg, commandName, command)
           }
         },
 
@@ -485,6 +736,15 @@ var app = new Vue({
           this.whisper.send(data, peer.publicKey)
         },
 
+        handleTTL(userMsg, commandName, command) {
+          var re = new RegExp("^(/"+commandName+")\\s+(\\d+)\\s*$");
+          var matches = userMsg.match(re);
+          if (!matches) {
+            return
+          }
+          this.messageTTL = parseInt(matches[2], 10);
+        },
+
         handleWhisper(userMsg, commandName, command) {
           var re = new RegExp("^(/"+commandName+")\\s+([^\\s]+)\\s+(.*)");
           var matches = userMsg.match(re);
@@ -499,6 +759,21 @@ var app = new Vue({
           this.whisper.send(data, peer.publicKey)
         },
 
+        handleAdmin(userMsg, commandName, command) {
+          var re = new RegExp("^(/"+commandName+")\\s+([^\\s]+)");
+          var matches = userMsg.match(re);
+          const peer = matches && this.peers.filter( this.whisper.isHandle(matches[2]) ).shift()
+          if (!peer) {
+            this.notify("User not found", notifType.error);
+            return
+          }
+          const data = {
+            type: adminCommands[commandName],
+            data: {publicKey: peer.publicKey},
+          }
+          this.whisper.send(data, this.serverpubkey)
+        },
+
         handleGrowl(userMsg, commandName, command) {
           var re = new RegExp("^(/"+commandName+")\\s+([^\\s]+)\\s+(.*)");
           var matches = userMsg.match(re);
@@ -539,7 +814,7 @@ var app = new Vue({
             const data = {
               type: MsgType.RoomDispose,
             }
-            this.whisper.sendMessage(data, this.serverpubkey);
+            this.whisper.send(data, this.serverpubkey);
         },
 
         // Flash notification.
@@ -835,6 +1110,41 @@ var app = new Vue({
             this.$forceUpdate();
         },
 
+        onAdmin(cleardata, data) {
+          if (data.from!==this.serverpubkey){
+            return
+          }
+          var handle = cleardata.publicKey;
+          if (cleardata.publicKey===this.whisper.mycrypto.publicKey()) {
+            handle = this.self.handle;
+          } else {
+            const peer = this.peers.filter( this.whisper.isPubKey(cleardata.publicKey) ).pop();
+            if (peer) {
+              handle = peer.handle;
+            }
+          }
+          const actions = {};
+          actions[MsgType.PeerKick] = "was kicked";
+          actions[MsgType.PeerBan] = "was banned";
+          actions[MsgType.PeerUnban] = "was unbanned";
+          actions[MsgType.PeerMute] = "was muted";
+          actions[MsgType.PeerUnmute] = "was unmuted";
+          actions[MsgType.RoomOwner] = "is now the owner of the room";
+          this.messages.push({
+              type: MsgType.Admin,
+              timestamp: new Date(),
+              message: `${handle} ${actions[cleardata.type]}`
+          });
+          this.scrollToNewester();
+        },
+
+        onNotice(cleardata, data) {
+          if (data.from!==this.serverpubkey){
+            return
+          }
+          this.notify(cleardata.message, notifType.error);
+        },
+
         onMotd(cleardata, data) {
           this.messages.push({
               type: cleardata.type,
@@ -858,7 +1168,7 @@ var app = new Vue({
             return
           }
           this.typingPeers.delete(from);
-          this.messages.push({
+          const msg = {
               type: cleardata.type,
               timestamp: new Date(),
               message: cleardata.data,
@@ -866,7 +1176,9 @@ var app = new Vue({
                   handle: peer.handle,
                   avatar: this.hashColor(from)
               }
-          });
+          };
+          this.messages.push(msg);
+          this.expireMessage(msg, data.expiresAt);
           this.scrollToNewester();
           // If the window isn't in focus, start the "new activity" animation
           // in the title bar.
@@ -876,66 +1188,55 @@ var app = new Vue({
           }
         },
 
+        // expireMessage removes a disappearing message once it expires.
+        expireMessage(msg, expiresAt) {
+          if (!expiresAt) {
+            return
+          }
+          window.setTimeout(() => {
+            this.messages = this.messages.filter((m) => m !== msg);
+          }, Math.max(Date.parse(expiresAt) - Date.now(), 0));
+        },
+
+        // onUpload displays the files shared by a peer. They are fetched
+        // and decrypted with the keys of the sealed message.
         onUpload(cleardata, data) {
-        //   var d = data.data.data;
-        //   if (data.type==MsgType.Uploading) {
-        //     var found = false;
-        //     this.messages.map((m) => {
-        //       if (m.uid===d.uid){
-        //         m.files=d.files;
-        //         m.percent=d.percent;
-        //         m.type=data.type;
-        //         found=true;
-        //       }
-        //     });
-        //     if(!found) {
-        //       this.messages.push({
-        //         type: data.type,
-        //         timestamp: new Date(),
-        //         uid: d.uid,
-        //         files: d.files,
-        //         percent: d.percent,
-        //         peer: {
-        //           id: data.data.peer_id,
-        //           handle: data.data.peer_handle,
-        //           avatar: this.hashColor(data.data.peer_id)
-        //         }
-        //       });
-        //     }
-        //   }else {
-        //     var found = false;
-        //     this.messages.map((m) => {
-        //       if (m.uid===d.uid){
-        //         if(d.res) {
-        //           m.res=d.res.data;
-        //         }
-        //         m.files = m.files || [];
-        //         m.err=d.err;
-        //         m.type=data.type;
-        //         found=true;
-        //       }
-        //     });
-        //     if(!found) {
-        //       var res = {};
-        //       if (d.res) {
-        //         res = d.res.data;
-        //       }
-        //       this.messages.push({
-        //         type: data.type,
-        //         timestamp: new Date(),
-        //         uid: d.uid,
-        //         res: res,
-        //         files: [],
-        //         err: d.err,
-        //         peer: {
-        //           id: data.data.peer_id,
-        //           handle: data.data.peer_handle,
-        //           avatar: this.hashColor(data.data.peer_id)
-        //         }
-        //       });
-        //     }
-        //   }
-        //   this.scrollToNewester();
+          const peer = this.peers.filter( this.whisper.isPubKey(data.from) ).pop();
+          if (!peer) {
+            console.error("peer not found", data.from)
+            return
+          }
+          const msg = {
+            type: MsgType.Upload,
+            timestamp: new Date(),
+            files: cleardata.data.files.map((f) => ({
+              name: f.name,
+              mimetype: f.mimetype,
+              url: null,
+              err: null,
+            })),
+            peer: {
+                handle: peer.handle,
+                avatar: this.hashColor(peer.publicKey)
+            }
+          };
+          this.messages.push(msg);
+          this.expireMessage(msg, data.expiresAt);
+          this.scrollToNewester();
+
+          cleardata.data.files.forEach((f, i) => {
+            openFile("/r/" + _room.id + "/uploaded/" + f.id,
+              nacl.util.decodeBase64(f.key), nacl.util.decodeBase64(f.nonce))
+              .then((parts) => {
+                // The type is set by the sender, only the images are
+                // displayed, the other files are downloaded as is.
+                const type = inlineTypes.includes(f.mimetype) ? f.mimetype : "application/octet-stream";
+                msg.files[i].url = URL.createObjectURL(new Blob(parts, { type: type }));
+              })
+              .catch((err) => {
+                msg.files[i].err = err.message;
+              });
+          });
         },
 
         onPing(cleardata, data) {
@@ -976,7 +1277,7 @@ var app = new Vue({
             console.error("peer not found", data.from)
             return
           }
-          this.messages.push({
+          const msg = {
             type: MsgType.Whisper,
             message: cleardata.data,
             timestamp: new Date(),
@@ -984,7 +1285,9 @@ var app = new Vue({
                 handle: peer.handle,
                 avatar: this.hashColor(peer.publicKey)
             }
-          });
+          };
+          this.messages.push(msg);
+          this.expireMessage(msg, data.expiresAt);
           this.scrollToNewester();
           if (!document.hasFocus()) {
             this.newActivity = true;
@@ -1033,53 +1336,126 @@ var app = new Vue({
           this.isDraggingOver=false
         },
 
-        // image upload
+        // uploadSealed uploads a file sealed with sealFile in chunks,
+        // resuming from the offset of the server after a failed chunk.
+        // It resolves with the stored file.
+        uploadSealed(sealed, onProgress) {
+          const base = "/r/" + _room.id + "/uploads";
+          return axios.post(base, null, { headers: { "Upload-Length": sealed.size } })
+            .then((resp) => {
+              const url = base + "/" + resp.data.data.id;
+              let retries = 0;
+              const send = (offset) => {
+                onProgress(offset);
+                if (offset >= sealed.size) {
+                  return axios.post(url + "/finalize").then((resp) => resp.data.data);
+                }
+                return sealed.read(offset, offset + uploadChunkSize).then((chunk) => axios.patch(url, chunk, {
+                  headers: {
+                    "Content-Type": "application/offset+octet-stream",
+                    "Upload-Offset": offset,
+                  },
+                })).then((resp) => parseInt(resp.headers["upload-offset"], 10), (err) => {
+                  const status = err.response ? err.response.status : 0;
+                  if (retries >= uploadRetries || (status >= 400 && status < 500 && status !== 409)) {
+                    throw err;
+                  }
+                  retries++;
+                  return new Promise((resolve) => window.setTimeout(resolve, 1000 * retries))
+                    .then(() => axios.head(url))
+                    .then((resp) => parseInt(resp.headers["upload-offset"], 10));
+                }).then(send);
+              };
+              return send(0);
+            });
+        },
+
+        // addFile encrypts the dropped files each with a new key, uploads
+        // the ciphertexts and shares their keys in a sealed message.
         addFile(e) {
-          // this.isDraggingOver=false
-          // // based on https://www.raymondcamden.com/2019/08/08/drag-and-drop-file-upload-in-vuejs
-          // let droppedFiles = e.dataTransfer.files;
-          // if(!droppedFiles) return;
-          // var uid = Math.round(new Date().getTime() + (Math.random() * 100));
-          // // this tip, convert FileList to array, credit: https://www.smashingmagazine.com/2018/01/drag-drop-file-uploader-vanilla-js/
-          // var ok = true;
-          // let formData = new FormData();
-          // var files = [];
-          // ([...droppedFiles]).forEach((f,x) => {
-          //   if (x>=20) {
-          //     this.notify("Too much files to upload", notifType.error);
-          //     ok = false;
-          //     return
-          //   }
-          //   formData.append('file'+(x), f);
-          //   files.push(f.name)
-          // })
-          // if (!ok) {
-          //   return
-          // }
-          // Client.sendMessage(Client.MsgType["uploading"], {uid:uid,files:files,percent:0});
-          //
-          // axios.post("/r/" + _room.id + "/upload", formData,
-          //   {
-          //     headers: {
-          //         'Content-Type': 'multipart/form-data'
-          //     },
-          //     onUploadProgress: function( progressEvent ) {
-          //       var p = parseInt( Math.round( ( progressEvent.loaded / progressEvent.total ) * 100 ) );
-          //       Client.sendMessage(Client.MsgType["uploading"], {uid:uid,files:files,percent:p});
-          //     }
-          //   }
-          // ).then(res => {
-          //   if (res.error){
-          //     this.notify(res.error, notifType.error);
-          //     Client.sendMessage(Client.MsgType["upload"], {uid:uid,err:res.error});
-          //   }else{
-          //     Client.sendMessage(Client.MsgType["upload"], {uid:uid,res:res.data});
-          //   }
-          // })
-          // .catch(err => {
-          //   Client.sendMessage(Client.MsgType["upload"], {uid:uid,err:err.message});
-          //   this.notify(err, notifType.error);
-          // });
+          this.isDraggingOver=false
+          // based on https://www.raymondcamden.com/2019/08/08/drag-and-drop-file-upload-in-vuejs
+          let droppedFiles = e.dataTransfer.files;
+          if(!droppedFiles) return;
+          // this tip, convert FileList to array, credit: https://www.smashingmagazine.com/2018/01/drag-drop-file-uploader-vanilla-js/
+          const files = [...droppedFiles];
+          if (files.length > 20) {
+            this.notify("Too much files to upload", notifType.error);
+            return
+          }
+
+          const msg = {
+            type: MsgType.Uploading,
+            timestamp: new Date(),
+            files: files.map((f) => f.name),
+            percent: 0,
+            peer: {
+                handle: this.handle,
+                avatar: this.hashColor(this.whisper.mycrypto.publicKey())
+            }
+          };
+          this.messages.push(msg);
+          this.scrollToNewester();
+          const done = () => {
+            this.messages = this.messages.filter((m) => m !== msg);
+          };
+
+          // The files are encrypted as they are uploaded.
+          Promise.resolve(files.map((f) => {
+            const key = nacl.randomBytes(nacl.secretbox.keyLength);
+            const nonce = nacl.randomBytes(16);
+            return {
+              file: f,
+              key: nacl.util.encodeBase64(key),
+              nonce: nacl.util.encodeBase64(nonce),
+              data: sealFile(f, key, nonce),
+            };
+          }))
+          .then((sealed) => {
+            // The files are uploaded one after the other.
+            const total = sealed.reduce((n, s) => n + s.data.size, 0);
+            let sent = 0;
+            const results = [];
+            return sealed.reduce((p, s) => p.then(() => this.uploadSealed(s.data, (offset) => {
+                msg.percent = Math.round(((sent + offset) / total) * 100);
+              })
+              .then((res) => results.push({ sealed: s, res: res }))
+              .catch((err) => {
+                const resp = err.response && err.response.data;
+                results.push({ sealed: s, err: resp && resp.error ? resp.error : err.message });
+              })
+              .then(() => { sent += s.data.size; })
+            ), Promise.resolve()).then(() => results);
+          })
+          .then((results) => {
+            done();
+            const shared = [];
+            results.forEach(({ sealed: s, res, err }) => {
+              if (err) {
+                this.notify("Failed to upload " + s.file.name + ": " + err, notifType.error);
+                return
+              }
+              shared.push({
+                id: res.id,
+                name: s.file.name,
+                mimetype: s.file.type || "application/octet-stream",
+                size: s.file.size,
+                key: s.key,
+                nonce: s.nonce,
+              });
+            });
+            if (shared.length > 0) {
+              this.whisper.broadcast({
+                type: MsgType.Upload,
+                data: { files: shared },
+              }, this.messageTTL);
+            }
+          })
+          .catch((err) => {
+            done();
+            const resp = err.response && err.response.data;
+            this.notify(resp && resp.error ? resp.error : err.message, notifType.error);
+          });
         },
 
         onResize(event) {
@@ -27,6 +27,9 @@ ChResults.DuplicateHandle = "duplicate.handle";
 ChResults.InvalidSealedAuth = "invalid.sealedauth";
 ChResults.OK = "ok";
 
+// maxPending is the maximum number of messages kept until their key is known.
+const maxPending = 500;
+
 class Whisper {
   constructor () {
     this.events = new EventEmitter();
@@ -46,6 +49,9 @@ class Whisper {
     // {from: public key b64, key: {publicKey: b64, secret: b64}, since: Date}
     this.sharedKeys = [];
 
+    // messages received before their key, such as the room backlog.
+    this.pending = [];
+
     // pubkey=>{token, since, result}
     this.tokens = {};
     this.peerStatus = {};
@@ -113,6 +119,7 @@ class Whisper {
     this.me = {};
     this.sharedKeys = []
     this.peers = []
+    this.pending = []
   }
 
   // onTransportError handles transport error.
@@ -128,6 +135,10 @@ class Whisper {
     } catch (e) {
       console.error("failed to json parse message ", e);
       return null;
+    }
+    // Disappearing messages are dropped once expired.
+    if (msg.expiresAt && Date.parse(msg.expiresAt) <= Date.now()) {
+      return null;
     }
 		var foundkey=null;
 		if (msg.to === this.mycrypto.publicKey()){
@@ -139,7 +150,11 @@ class Whisper {
       }
 		}
     if (!foundkey) {
-      console.error("key not found for ", msg)
+      // Keep it until a peer shares the key.
+      this.pending.push(message);
+      if (this.pending.length > maxPending) {
+        this.pending.shift();
+      }
       return
     }
 
@@ -175,7 +190,8 @@ class Whisper {
 	}
 
 	// broadcast, encrypt and authenticate a message using given sharedKey.
-	broadcast (msg) {
+	// ttl is the lifetime of the message in seconds, the room default if unset.
+	broadcast (msg, ttl) {
     // console.log("brd", this.mycrypto.publicKey(), msg)
     const oldest = this.peers.filter(this.iAccepted).sort(this.sortBySince).pop();
     if (!oldest) {
@@ -195,7 +211,11 @@ class Whisper {
 		var crypto = new CryptoUtils(key.key);
 		const nonce = crypto.newNonce();
 		const data = this.mycrypto.encrypt(JSON.stringify(msg), nonce, crypto.publicKey());
-		this.transport.send({ "data": data, "nonce": nonce, "from": bPub, "to": key.key.publicKey });
+		var envelope = { "data": data, "nonce": nonce, "from": bPub, "to": key.key.publicKey };
+		if (ttl > 0) {
+			envelope.ttl = ttl;
+		}
+		this.transport.send(envelope);
 	}
 
 	// broadcastDirect send a message to each accepted peer.
@@ -319,6 +339,21 @@ class Whisper {
     });
   }
 
+  // replayPending processes the pending messages sent to the given shared key.
+  replayPending(publicKey) {
+    var msgs = [];
+    this.pending = this.pending.filter((m) => {
+      try {
+        if (JSON.parse(m).to === publicKey) {
+          msgs.push(m);
+          return false
+        }
+      } catch (e) {}
+      return true
+    })
+    msgs.map(this.onTransportMessage.bind(this))
+  }
+
   // issueChallenge sends a challenge to the remote to accept us.
   // The challenge is a hash of the room password, the since server time value,
   // a nonce, and the peer public key.
@@ -501,6 +536,7 @@ class Whisper {
       this.sharedKeys.push({from: remote.publicKey, key: cleardata.shared, since: remote.since});
       this.setPeerStatus(remote.publicKey, ChResults.OK)
       this.trigger(EvType.PeerAccept, JSON.parse(JSON.stringify(remote)))
+      this.replayPending(cleardata.shared.publicKey)
 
     } else{
       if ( this.isPeerStatus(remote.publicKey, ChResults.OK) ) {
@@ -66,7 +66,7 @@ class WsTransport {
     };
     this.ws.onclose = (e) => {
       if (e.code == 1000) {
-        if (e.reason && MsgType.hasOwnProperty(e.reason)) {
+        if (e.reason && Object.values(MsgType).indexOf(e.reason) > -1) {
           that.trigger("disconnect", e.reason);
           return
         }
@@ -1,57 +1,132 @@
 package main
 
 import (
-	"log"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
 
 	"github.com/knadh/niltalk/store"
+	"github.com/knadh/niltalk/store/bolt"
+	"github.com/knadh/niltalk/store/crypt"
 	"github.com/knadh/niltalk/store/fs"
 	"github.com/knadh/niltalk/store/mem"
 	"github.com/knadh/niltalk/store/redis"
 )
 
 // makeStore creates a new store.Store instance
-// according to configuration options
+// according to configuration options. Values are encrypted
+// if a store encryption key is configured.
 func (a *App) makeStore() (store.Store, error) {
+	store, err := a.makeBackend(a.cfg.Storage, "store")
+	if err != nil {
+		return nil, err
+	}
+	passphrase, err := readStoreKey(ko.String("store.encryption_key_file"), ko.String("store.encryption_key"))
+	if err != nil {
+		return nil, err
+	}
+	if passphrase == nil {
+		return store, nil
+	}
+	return crypt.New(store, passphrase)
+}
+
+// makeBackend creates a store.Store backend of the given kind,
+// configured by the options found at cfgKey.
+func (a *App) makeBackend(kind, cfgKey string) (store.Store, error) {
 	var store store.Store
-	if a.cfg.Storage == "redis" {
+	if kind == "redis" {
 		var storeCfg redis.Config
-		if err := ko.Unmarshal("store", &storeCfg); err != nil {
-			logger.Fatalf("error unmarshalling 'store' config: %v", err)
+		if err := ko.Unmarshal(cfgKey, &storeCfg); err != nil {
+			logger.Fatalf("error unmarshalling '%s' config: %v", cfgKey, err)
 		}
 
 		s, err := redis.New(storeCfg)
 		if err != nil {
-			log.Fatalf("error initializing store: %v", err)
+			logger.Fatalf("error initializing store: %v", err)
 		}
 		store = s
 
-	} else if a.cfg.Storage == "memory" {
+	} else if kind == "memory" {
 		var storeCfg mem.Config
-		if err := ko.Unmarshal("store", &storeCfg); err != nil {
-			logger.Fatalf("error unmarshalling 'store' config: %v", err)
+		if err := ko.Unmarshal(cfgKey, &storeCfg); err != nil {
+			logger.Fatalf("error unmarshalling '%s' config: %v", cfgKey, err)
 		}
 
 		s, err := mem.New(storeCfg)
 		if err != nil {
-			log.Fatalf("error initializing store: %v", err)
+			logger.Fatalf("error initializing store: %v", err)
 		}
 		store = s
 
-	} else if a.cfg.Storage == "fs" {
+	} else if kind == "fs" {
 		var storeCfg fs.Config
-		if err := ko.Unmarshal("store", &storeCfg); err != nil {
-			logger.Fatalf("error unmarshalling 'store' config: %v", err)
+		if err := ko.Unmarshal(cfgKey, &storeCfg); err != nil {
+			logger.Fatalf("error unmarshalling '%s' config: %v", cfgKey, err)
+		}
+
+		s, err := fs.New(storeCfg, logger.Std())
+		if err != nil {
+			logger.Fatalf("error initializing store: %v", err)
+		}
+		store = s
+
+	} else if kind == "bolt" {
+		var storeCfg bolt.Config
+		if err := ko.Unmarshal(cfgKey, &storeCfg); err != nil {
+			logger.Fatalf("error unmarshalling '%s' config: %v", cfgKey, err)
 		}
 
-		s, err := fs.New(storeCfg, logger)
+		s, err := bolt.New(storeCfg, logger.Std())
 		if err != nil {
-			log.Fatalf("error initializing store: %v", err)
+			logger.Fatalf("error initializing store: %v", err)
 		}
 		store = s
-		defer s.Close()
 
 	} else {
-		logger.Fatal("app.storage must be one of redis|memory|fs")
+		return nil, fmt.Errorf("unknown storage %q, must be one of redis|memory|fs|bolt", kind)
 	}
 	return store, nil
 }
+
+// readStoreKey returns the store encryption passphrase read from a file,
+// or the given one if the file path is empty. It returns nil if none is set.
+func readStoreKey(path, passphrase string) ([]byte, error) {
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		b = bytes.TrimSpace(b)
+		if len(b) == 0 {
+			return nil, errors.New("store encryption key file is empty")
+		}
+		return b, nil
+	}
+	if passphrase != "" {
+		return []byte(passphrase), nil
+	}
+	return nil, nil
+}
+
+// rotateStoreKey re-encrypts the values of the store with the
+// passphrase read from newKeyFile.
+func (a *App) rotateStoreKey(newKeyFile string) (int, error) {
+	if newKeyFile == "" {
+		return 0, errors.New("--new-store-key-file is required")
+	}
+	newKey, err := readStoreKey(newKeyFile, "")
+	if err != nil {
+		return 0, err
+	}
+	oldKey, err := readStoreKey(ko.String("store.encryption_key_file"), ko.String("store.encryption_key"))
+	if err != nil {
+		return 0, err
+	}
+	s, err := a.makeBackend(a.cfg.Storage, "store")
+	if err != nil {
+		return 0, err
+	}
+	return crypt.Rotate(s, oldKey, newKey)
+}
@@ -0,0 +1,222 @@
+package bolt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/knadh/niltalk/store"
+	bbolt "go.etcd.io/bbolt"
+)
+
+var (
+	// bucketData holds the values.
+	bucketData = []byte("data")
+	// bucketExpires holds the expiry of the keys set with a TTL.
+	bucketExpires = []byte("expires")
+)
+
+// Config represents the bolt store config structure.
+type Config struct {
+	Path string `koanf:"path"`
+}
+
+// Bolt represents the embedded bbolt implementation of the Store interface.
+type Bolt struct {
+	cfg *Config
+	db  *bbolt.DB
+	log *log.Logger
+}
+
+// New returns a new bolt store.
+func New(cfg Config, log *log.Logger) (*Bolt, error) {
+	if cfg.Path == "" {
+		cfg.Path = "db.bolt"
+	}
+	db, err := bbolt.Open(cfg.Path, 0600, &bbolt.Options{Timeout: time.Second * 5})
+	if err != nil {
+		return nil, fmt.Errorf("error opening %q: %v", cfg.Path, err)
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(bucketData); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(bucketExpires)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	store := &Bolt{
+		cfg: &cfg,
+		db:  db,
+		log: log,
+	}
+	go store.watch()
+	return store, nil
+}
+
+// watch the store to clean it up.
+func (b *Bolt) watch() {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for range t.C {
+		if err := b.cleanup(); err == bbolt.ErrDatabaseNotOpen {
+			return
+		} else if err != nil {
+			b.log.Printf("error cleaning up %q: %v", b.cfg.Path, err)
+		}
+	}
+}
+
+// cleanup the store to removes expired items.
+func (b *Bolt) cleanup() error {
+	now := time.Now()
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		var (
+			data    = tx.Bucket(bucketData)
+			expires = tx.Bucket(bucketExpires)
+			keys    [][]byte
+		)
+		err := expires.ForEach(func(k, v []byte) error {
+			if decodeTime(v).Before(now) {
+				keys = append(keys, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := data.Delete(k); err != nil {
+				return err
+			}
+			if err := expires.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Close the underlying database file.
+func (b *Bolt) Close() error {
+	return b.db.Close()
+}
+
+// Get value from a key.
+func (b *Bolt) Get(key string) ([]byte, error) {
+	var out []byte
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		d := tx.Bucket(bucketData).Get([]byte(key))
+		if d == nil || expired(tx, []byte(key), time.Now()) {
+			return store.ErrNotFound
+		}
+		out = make([]byte, len(d), len(d))
+		copy(out, d)
+		return nil
+	})
+	return out, err
+}
+
+// Set a value.
+func (b *Bolt) Set(key string, data []byte) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		if err := tx.Bucket(bucketData).Put([]byte(key), data); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketExpires).Delete([]byte(key))
+	})
+}
+
+// SetWithTTL sets a value that expires after ttl.
+func (b *Bolt) SetWithTTL(key string, data []byte, ttl time.Duration) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		if err := tx.Bucket(bucketData).Put([]byte(key), data); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketExpires).Put([]byte(key), encodeTime(time.Now().Add(ttl)))
+	})
+}
+
+// Expire sets the expiry of a key.
+func (b *Bolt) Expire(key string, ttl time.Duration) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		now := time.Now()
+		if tx.Bucket(bucketData).Get([]byte(key)) == nil || expired(tx, []byte(key), now) {
+			return store.ErrNotFound
+		}
+		return tx.Bucket(bucketExpires).Put([]byte(key), encodeTime(now.Add(ttl)))
+	})
+}
+
+// TTL returns the time left before the key expires, 0 if it does not expire.
+func (b *Bolt) TTL(key string) (time.Duration, error) {
+	var ttl time.Duration
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		now := time.Now()
+		if tx.Bucket(bucketData).Get([]byte(key)) == nil || expired(tx, []byte(key), now) {
+			return store.ErrNotFound
+		}
+		if v := tx.Bucket(bucketExpires).Get([]byte(key)); v != nil {
+			ttl = decodeTime(v).Sub(now)
+		}
+		return nil
+	})
+	return ttl, err
+}
+
+// Delete a value.
+func (b *Bolt) Delete(key string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		if err := tx.Bucket(bucketData).Delete([]byte(key)); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketExpires).Delete([]byte(key))
+	})
+}
+
+// Iterate calls fn for each key starting with prefix, in lexical order.
+// The store must not be modified from within fn, nor read as nested
+// read transactions can deadlock with a pending write.
+func (b *Bolt) Iterate(prefix string, fn func(key string, data []byte) error) error {
+	return b.db.View(func(tx *bbolt.Tx) error {
+		var (
+			now = time.Now()
+			c   = tx.Bucket(bucketData).Cursor()
+		)
+		for k, v := c.Seek([]byte(prefix)); k != nil && strings.HasPrefix(string(k), prefix); k, v = c.Next() {
+			if expired(tx, k, now) {
+				continue
+			}
+			d := make([]byte, len(v), len(v))
+			copy(d, v)
+			if err := fn(string(k), d); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// expired returns true if the key has expired but was not cleaned up yet.
+func expired(tx *bbolt.Tx, key []byte, now time.Time) bool {
+	v := tx.Bucket(bucketExpires).Get(key)
+	return v != nil && decodeTime(v).Before(now)
+}
+
+func encodeTime(t time.Time) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(t.UnixNano()))
+	return b
+}
+
+func decodeTime(b []byte) time.Time {
+	if len(b) != 8 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+}
@@ -0,0 +1,370 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/knadh/niltalk/store"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Keys of the encryption metadata, stored in plain text next to the data.
+const (
+	// KeySalt is the key of the salt of the key derivation function.
+	KeySalt = "STORE:SALT"
+	// KeyCheck is the key of a known value used to verify the passphrase.
+	KeyCheck = "STORE:CHECK"
+	// KeyNextSalt is the key of the salt of the new key while the store
+	// is being rotated to it.
+	KeyNextSalt = "STORE:NEXTSALT"
+)
+
+// magic prefixes every encrypted value.
+var magic = []byte("NILENC1:")
+
+// checkValue is encrypted under KeyCheck to verify the passphrase.
+var checkValue = []byte("niltalk")
+
+var (
+	// ErrInvalidKey indicates that the passphrase does not match the one
+	// the store was encrypted with.
+	ErrInvalidKey = errors.New("invalid store encryption key")
+
+	// ErrUnencrypted indicates that the store holds data that was not
+	// encrypted and must be converted first.
+	ErrUnencrypted = errors.New("store contains unencrypted data, run --rotate-store-key to encrypt it")
+
+	// ErrRotating indicates that a key rotation was interrupted, leaving
+	// values encrypted with either key.
+	ErrRotating = errors.New("store key rotation was interrupted, run --rotate-store-key again to complete it")
+)
+
+// Store wraps a store.Store to encrypt the values at rest with
+// XChaCha20-Poly1305, using a key derived from a passphrase with argon2id.
+// Keys are stored in plain text as backends need them for lookups, each
+// value is authenticated along with its key so they can not be swapped.
+type Store struct {
+	store store.Store
+	aead  cipher.AEAD
+}
+
+// New returns a new encrypting store wrapping s.
+// A new salt is generated if the store is empty.
+func New(s store.Store, passphrase []byte) (*Store, error) {
+	if next, err := s.Get(KeyNextSalt); len(next) > 0 && err == nil {
+		return nil, ErrRotating
+	}
+	salt, err := s.Get(KeySalt)
+	if len(salt) == 0 || err != nil {
+		empty, err := isEmpty(s)
+		if err != nil {
+			return nil, err
+		}
+		if !empty {
+			return nil, ErrUnencrypted
+		}
+		return initStore(s, passphrase)
+	}
+
+	c := &Store{store: s}
+	if c.aead, err = newAEAD(passphrase, salt); err != nil {
+		return nil, err
+	}
+	v, err := c.Get(KeyCheck)
+	if err != nil || !bytes.Equal(v, checkValue) {
+		return nil, ErrInvalidKey
+	}
+	return c, nil
+}
+
+// initStore generates a new salt and writes the encryption metadata to s.
+func initStore(s store.Store, passphrase []byte) (*Store, error) {
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	c := &Store{store: s, aead: aead}
+	if err := s.Set(KeySalt, salt); err != nil {
+		return nil, err
+	}
+	if err := c.Set(KeyCheck, checkValue); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// newAEAD derives the encryption key from the passphrase.
+func newAEAD(passphrase, salt []byte) (cipher.AEAD, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("empty store encryption key")
+	}
+	key := argon2.IDKey(passphrase, salt, 1, 64*1024, 4, chacha20poly1305.KeySize)
+	return chacha20poly1305.NewX(key)
+}
+
+// isEmpty returns true if the store holds no data.
+func isEmpty(s store.Store) (bool, error) {
+	it, ok := s.(store.Iterator)
+	if !ok {
+		return false, errors.New("store does not support encryption")
+	}
+	errFound := errors.New("found")
+	err := it.Iterate("", func(string, []byte) error {
+		return errFound
+	})
+	if err == errFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Backend returns the wrapped store.
+func (c *Store) Backend() store.Store {
+	return c.store
+}
+
+// seal encrypts a value.
+func (c *Store) seal(key string, data []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(data)+c.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	out := append([]byte{}, magic...)
+	return append(out, c.aead.Seal(nonce, nonce, data, []byte(key))...), nil
+}
+
+// open decrypts a value.
+func (c *Store) open(key string, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, magic) {
+		return nil, errors.New("value is not encrypted")
+	}
+	data = data[len(magic):]
+	if len(data) < c.aead.NonceSize() {
+		return nil, errors.New("invalid encrypted value")
+	}
+	nonce, data := data[:c.aead.NonceSize()], data[c.aead.NonceSize():]
+	out, err := c.aead.Open(nil, nonce, data, []byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting value: %v", err)
+	}
+	return out, nil
+}
+
+// Get value from a key.
+func (c *Store) Get(key string) ([]byte, error) {
+	d, err := c.store.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return c.open(key, d)
+}
+
+// Set a value.
+func (c *Store) Set(key string, data []byte) error {
+	d, err := c.seal(key, data)
+	if err != nil {
+		return err
+	}
+	return c.store.Set(key, d)
+}
+
+// SetWithTTL sets a value that expires after ttl.
+func (c *Store) SetWithTTL(key string, data []byte, ttl time.Duration) error {
+	d, err := c.seal(key, data)
+	if err != nil {
+		return err
+	}
+	return c.store.SetWithTTL(key, d, ttl)
+}
+
+// Reserve sets a value that expires after ttl if the key does not exist.
+func (c *Store) Reserve(key string, data []byte, ttl time.Duration) (bool, error) {
+	res, ok := c.store.(store.Reserver)
+	if !ok {
+		return false, errors.New("store does not support reservations")
+	}
+	d, err := c.seal(key, data)
+	if err != nil {
+		return false, err
+	}
+	return res.Reserve(key, d, ttl)
+}
+
+// Expire sets the expiry of a key.
+func (c *Store) Expire(key string, ttl time.Duration) error {
+	return c.store.Expire(key, ttl)
+}
+
+// Delete a value.
+func (c *Store) Delete(key string) error {
+	return c.store.Delete(key)
+}
+
+// Iterate calls fn for each key starting with prefix with its decrypted value.
+// The encryption metadata are skipped.
+func (c *Store) Iterate(prefix string, fn func(key string, data []byte) error) error {
+	it, ok := c.store.(store.Iterator)
+	if !ok {
+		return errors.New("store does not support iteration")
+	}
+	return it.Iterate(prefix, func(key string, data []byte) error {
+		if isMeta(key) {
+			return nil
+		}
+		d, err := c.open(key, data)
+		if err != nil {
+			return err
+		}
+		return fn(key, d)
+	})
+}
+
+// Close the wrapped store if it needs to.
+func (c *Store) Close() error {
+	if cl, ok := c.store.(io.Closer); ok {
+		return cl.Close()
+	}
+	return nil
+}
+
+// isMeta returns true if key holds encryption metadata.
+func isMeta(key string) bool {
+	return key == KeySalt || key == KeyCheck || key == KeyNextSalt
+}
+
+// rotated is a value being re-encrypted.
+type rotated struct {
+	key  string
+	data []byte
+	ttl  time.Duration
+}
+
+// Rotate re-encrypts all the values of the backend s with a key derived from
+// newPassphrase. An empty oldPassphrase indicates that the values are not
+// encrypted yet. Expiries are preserved if the backend reports them.
+//
+// The salt of the new key is recorded first, then the values are rewritten,
+// and the salt and check value of the store are swapped last. If the rotation
+// is interrupted, the store refuses to open until Rotate is run again with
+// the same passphrases, which completes it as the values already rewritten
+// are recognized. It returns the number of re-encrypted values.
+func Rotate(s store.Store, oldPassphrase, newPassphrase []byte) (int, error) {
+	it, ok := s.(store.Iterator)
+	if !ok {
+		return 0, errors.New("store does not support iteration")
+	}
+
+	// Resume an interrupted rotation with the same new salt.
+	nextSalt, err := s.Get(KeyNextSalt)
+	resume := len(nextSalt) > 0 && err == nil
+	if !resume {
+		nextSalt = make([]byte, 16)
+		if _, err := io.ReadFull(rand.Reader, nextSalt); err != nil {
+			return 0, err
+		}
+	}
+	aead, err := newAEAD(newPassphrase, nextSalt)
+	if err != nil {
+		return 0, err
+	}
+	next := &Store{store: s, aead: aead}
+
+	// The values are decrypted with the old key, unless the salt was already
+	// swapped by the interrupted rotation. A nil old store indicates that
+	// the values are not encrypted.
+	var old *Store
+	salt, err := s.Get(KeySalt)
+	hasSalt := len(salt) > 0 && err == nil
+	switch {
+	case hasSalt && bytes.Equal(salt, nextSalt):
+		// All the values were rewritten.
+	case hasSalt && len(oldPassphrase) == 0:
+		return 0, errors.New("store is encrypted, the current key is required")
+	case hasSalt:
+		aead, err := newAEAD(oldPassphrase, salt)
+		if err != nil {
+			return 0, err
+		}
+		old = &Store{store: s, aead: aead}
+		if v, err := old.Get(KeyCheck); err != nil || !bytes.Equal(v, checkValue) {
+			return 0, ErrInvalidKey
+		}
+	}
+
+	var values []rotated
+	err = it.Iterate("", func(key string, d []byte) error {
+		if !isMeta(key) {
+			values = append(values, rotated{key: key, data: d})
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// Values are all decrypted before anything is written. The values
+	// rewritten by an interrupted rotation are skipped.
+	todo := values[:0]
+	for _, v := range values {
+		if _, err := next.open(v.key, v.data); err == nil {
+			continue
+		}
+		if old != nil {
+			if v.data, err = old.open(v.key, v.data); err != nil {
+				return 0, err
+			}
+		} else if bytes.HasPrefix(v.data, magic) {
+			return 0, errors.New("store contains values encrypted with another key")
+		}
+		todo = append(todo, v)
+	}
+
+	if !resume {
+		if err := s.Set(KeyNextSalt, nextSalt); err != nil {
+			return 0, err
+		}
+	}
+
+	// The expiries are read once the keys are listed as the backends
+	// lock their data while iterating.
+	ttlr, _ := s.(store.TTLReader)
+	n := 0
+	for _, v := range todo {
+		if ttlr != nil {
+			ttl, err := ttlr.TTL(v.key)
+			if err != nil {
+				// The key expired in the meantime.
+				continue
+			}
+			v.ttl = ttl
+		}
+		if v.ttl > 0 {
+			err = next.SetWithTTL(v.key, v.data, v.ttl)
+		} else {
+			err = next.Set(v.key, v.data)
+		}
+		if err != nil {
+			return n, fmt.Errorf("error writing value: %v", err)
+		}
+		n++
+	}
+
+	// Swap the key of the store.
+	if err := s.Set(KeySalt, nextSalt); err != nil {
+		return n, err
+	}
+	if err := next.Set(KeyCheck, checkValue); err != nil {
+		return n, err
+	}
+	return n, s.Delete(KeyNextSalt)
+}
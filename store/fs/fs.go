@@ -1,13 +1,27 @@
 package fs
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/knadh/niltalk/store"
+)
+
+// Operations recorded in the write-ahead log.
+const (
+	opSet    = "set"
+	opDelete = "delete"
+	opExpire = "expire"
 )
 
 // Config represents the file store config structure.
@@ -16,24 +30,58 @@ type Config struct {
 }
 
 // File represents the file implementation of the Store interface.
+// Mutations are appended to a write-ahead log and synced to disk before
+// being applied, the log is periodically compacted into a snapshot of the
+// whole data set at cfg.Path.
 type File struct {
-	cfg   *Config
-	data  map[string][]byte
-	mu    sync.Mutex
-	dirty bool
-	log   *log.Logger
+	cfg     *Config
+	data    map[string][]byte
+	expires map[string]time.Time
+	mu      sync.Mutex
+	dirty   bool
+	wal     *os.File
+	walSize int64
+	log     *log.Logger
+}
+
+// snapshot is the content of the data file.
+type snapshot struct {
+	Data    map[string][]byte
+	Expires map[string]time.Time
+}
+
+// entry is a mutation recorded in the write-ahead log.
+type entry struct {
+	Op      string    `json:"op"`
+	Key     string    `json:"key"`
+	Value   []byte    `json:"value,omitempty"`
+	Expires time.Time `json:"expires"`
 }
 
 // New returns a new Redis store.
 func New(cfg Config, log *log.Logger) (*File, error) {
+	if cfg.Path == "" {
+		cfg.Path = "db.json"
+	}
 	store := &File{
-		cfg:  &cfg,
-		data: map[string][]byte{},
-		log:  log,
+		cfg:     &cfg,
+		data:    map[string][]byte{},
+		expires: map[string]time.Time{},
+		log:     log,
+	}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	wal, err := os.OpenFile(store.walPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	store.wal = wal
+	if fi, err := wal.Stat(); err == nil {
+		store.walSize = fi.Size()
 	}
-	err := store.load()
 	go store.watch()
-	return store, err
+	return store, nil
 }
 
 // watch the store to clean it up.
@@ -48,58 +96,209 @@ func (m *File) watch() {
 
 // cleanup the store to removes expired items.
 func (m *File) cleanup() {
-	// m.mu.Lock()
-	// defer m.mu.Unlock()
-	//
-	// now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for key, exp := range m.expires {
+		if exp.Before(now) {
+			delete(m.data, key)
+			delete(m.expires, key)
+			m.dirty = true
+		}
+	}
+}
+
+// expired returns true if the key has expired but was not cleaned up yet.
+// It must be called with the lock held.
+func (m *File) expired(key string) bool {
+	exp, ok := m.expires[key]
+	return ok && exp.Before(time.Now())
+}
 
+// walPath returns the path of the write-ahead log.
+func (m *File) walPath() string {
+	return m.cfg.Path + ".log"
 }
 
-// load the data from the file system.
+// load the snapshot from the file system, then replays the write-ahead log.
+// A truncated tail left by a crash in the middle of an append is discarded,
+// a corrupt entry anywhere else fails the load.
 func (m *File) load() error {
 	if _, err := os.Stat(m.cfg.Path); err == nil {
-		x := struct {
-			Data map[string][]byte
-		}{}
-		var data []byte
-		data, err = ioutil.ReadFile(m.cfg.Path)
+		var x snapshot
+		data, err := ioutil.ReadFile(m.cfg.Path)
 		if err != nil {
 			return err
 		}
-		err = json.Unmarshal(data, &x)
-		if err != nil {
+		if err := json.Unmarshal(data, &x); err != nil {
+			return fmt.Errorf("error decoding %q: %v", m.cfg.Path, err)
+		}
+		if x.Data != nil {
+			m.data = x.Data
+		}
+		if x.Expires != nil {
+			m.expires = x.Expires
+		}
+	}
+
+	f, err := os.OpenFile(m.walPath(), os.O_RDWR, 0600)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var (
+		r      = bufio.NewReader(f)
+		offset int64
+		n      int
+	)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
 			return err
 		}
-		m.data = x.Data
+
+		// Only the last entry can be torn by a crash in the middle of an
+		// append, a corrupt entry followed by others is not discarded
+		// along with them.
+		var e entry
+		if err == io.EOF || json.Unmarshal(bytes.TrimSpace(line), &e) != nil {
+			if err != io.EOF {
+				if _, perr := r.Peek(1); perr != io.EOF {
+					return fmt.Errorf("corrupt entry in write-ahead log %q at offset %v", m.walPath(), offset)
+				}
+			}
+			m.log.Printf("discarding truncated write-ahead log %q after %v entries", m.walPath(), n)
+			if err := f.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		m.apply(e)
+		offset += int64(len(line))
+		n++
+	}
+	if n > 0 {
+		m.dirty = true
 	}
 	return nil
 }
 
-// save the data to the file system.
+// save compacts the write-ahead log into a new snapshot of the data.
+// The snapshot is written to a temporary file which is synced and
+// renamed over the previous one.
 func (m *File) save() error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	if m.dirty {
-		data, err := json.Marshal(struct {
-			Data map[string][]byte
-		}{
-			Data: m.data,
-		})
-		if err == nil {
-			m.dirty = false
-			err = ioutil.WriteFile(m.cfg.Path, data, os.ModePerm)
-			if err != nil {
-				m.log.Printf("error writing file %q: %v", m.cfg.Path, err)
-			}
+	if !m.dirty {
+		return nil
+	}
+	err := m.writeSnapshot()
+	if err == nil {
+		m.dirty = false
+		if err = m.wal.Truncate(0); err == nil {
+			m.walSize = 0
 		}
+	}
+	if err != nil {
+		m.log.Printf("error writing file %q: %v", m.cfg.Path, err)
+	}
+	return err
+}
+
+// writeSnapshot atomically replaces the data file with the current data.
+// It must be called with the lock held.
+func (m *File) writeSnapshot() error {
+	data, err := json.Marshal(snapshot{
+		Data:    m.data,
+		Expires: m.expires,
+	})
+	if err != nil {
 		return err
 	}
-	return nil
+
+	dir := filepath.Dir(m.cfg.Path)
+	f, err := ioutil.TempFile(dir, filepath.Base(m.cfg.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), m.cfg.Path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	// Sync the directory for the rename to be durable.
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
 }
 
 // Close and save the data to the file system.
 func (m *File) Close() error {
-	return m.save()
+	err := m.save()
+	if cerr := m.wal.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// write appends an entry to the write-ahead log, syncs it, then applies it.
+// It must be called with the lock held.
+func (m *File) write(e entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	n, err := m.wal.Write(append(b, '\n'))
+	if err == nil {
+		err = m.wal.Sync()
+	}
+	if err != nil {
+		// Do not leave a partial entry ahead of the next ones.
+		m.wal.Truncate(m.walSize)
+		return err
+	}
+	m.walSize += int64(n)
+	m.apply(e)
+	m.dirty = true
+	return nil
+}
+
+// apply a log entry to the data.
+func (m *File) apply(e entry) {
+	switch e.Op {
+	case opSet:
+		m.data[e.Key] = make([]byte, len(e.Value), len(e.Value))
+		copy(m.data[e.Key], e.Value)
+		if e.Expires.IsZero() {
+			delete(m.expires, e.Key)
+		} else {
+			m.expires[e.Key] = e.Expires
+		}
+	case opExpire:
+		m.expires[e.Key] = e.Expires
+	case opDelete:
+		delete(m.data, e.Key)
+		delete(m.expires, e.Key)
+	}
 }
 
 // Get value from a key.
@@ -107,8 +306,8 @@ func (m *File) Get(key string) ([]byte, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	d, ok := m.data[key]
-	if !ok {
-		return nil, fmt.Errorf("key %q not found", key)
+	if !ok || m.expired(key) {
+		return nil, store.ErrNotFound
 	}
 	return d, nil
 }
@@ -117,9 +316,53 @@ func (m *File) Get(key string) ([]byte, error) {
 func (m *File) Set(key string, data []byte) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.data[key] = make([]byte, len(data), len(data))
-	copy(m.data[key], data)
-	m.dirty = true
+	return m.write(entry{Op: opSet, Key: key, Value: data})
+}
+
+// SetWithTTL sets a value that expires after ttl.
+func (m *File) SetWithTTL(key string, data []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.write(entry{Op: opSet, Key: key, Value: data, Expires: time.Now().Add(ttl)})
+}
+
+// Expire sets the expiry of a key.
+func (m *File) Expire(key string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.data[key]; !ok || m.expired(key) {
+		return store.ErrNotFound
+	}
+	return m.write(entry{Op: opExpire, Key: key, Expires: time.Now().Add(ttl)})
+}
+
+// TTL returns the time left before the key expires, 0 if it does not expire.
+func (m *File) TTL(key string) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.data[key]; !ok || m.expired(key) {
+		return 0, store.ErrNotFound
+	}
+	exp, ok := m.expires[key]
+	if !ok {
+		return 0, nil
+	}
+	return time.Until(exp), nil
+}
+
+// Iterate calls fn for each key starting with prefix.
+// The store must not be accessed from within fn, its lock is held.
+func (m *File) Iterate(prefix string, fn func(key string, data []byte) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, d := range m.data {
+		if !strings.HasPrefix(key, prefix) || m.expired(key) {
+			continue
+		}
+		if err := fn(key, d); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -127,7 +370,5 @@ func (m *File) Set(key string, data []byte) error {
 func (m *File) Delete(key string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	delete(m.data, key)
-	m.dirty = true
-	return nil
+	return m.write(entry{Op: opDelete, Key: key})
 }
@@ -1,9 +1,11 @@
 package mem
 
 import (
-	"fmt"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/knadh/niltalk/store"
 )
 
 // Config represents the InMemory store config structure.
@@ -11,16 +13,18 @@ type Config struct{}
 
 // InMemory represents the in-memory implementation of the Store interface.
 type InMemory struct {
-	cfg  *Config
-	data map[string][]byte
-	mu   sync.Mutex
+	cfg     *Config
+	data    map[string][]byte
+	expires map[string]time.Time
+	mu      sync.Mutex
 }
 
 // New returns a new Redis store.
 func New(cfg Config) (*InMemory, error) {
 	store := &InMemory{
-		cfg:  &cfg,
-		data: map[string][]byte{},
+		cfg:     &cfg,
+		data:    map[string][]byte{},
+		expires: map[string]time.Time{},
 	}
 	go store.watch()
 	return store, nil
@@ -37,11 +41,23 @@ func (m *InMemory) watch() {
 
 // cleanup the store to removes expired items.
 func (m *InMemory) cleanup() {
-	// m.mu.Lock()
-	// defer m.mu.Unlock()
-	//
-	// now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
+	now := time.Now()
+	for key, exp := range m.expires {
+		if exp.Before(now) {
+			delete(m.data, key)
+			delete(m.expires, key)
+		}
+	}
+}
+
+// expired returns true if the key has expired but was not cleaned up yet.
+// It must be called with the lock held.
+func (m *InMemory) expired(key string) bool {
+	exp, ok := m.expires[key]
+	return ok && exp.Before(time.Now())
 }
 
 // Get value from a key.
@@ -49,8 +65,8 @@ func (m *InMemory) Get(key string) ([]byte, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	d, ok := m.data[key]
-	if !ok {
-		return nil, fmt.Errorf("key %q not found", key)
+	if !ok || m.expired(key) {
+		return nil, store.ErrNotFound
 	}
 	return d, nil
 }
@@ -61,6 +77,58 @@ func (m *InMemory) Set(key string, data []byte) error {
 	defer m.mu.Unlock()
 	m.data[key] = make([]byte, len(data), len(data))
 	copy(m.data[key], data)
+	delete(m.expires, key)
+	return nil
+}
+
+// SetWithTTL sets a value that expires after ttl.
+func (m *InMemory) SetWithTTL(key string, data []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data[key] = make([]byte, len(data), len(data))
+	copy(m.data[key], data)
+	m.expires[key] = time.Now().Add(ttl)
+	return nil
+}
+
+// Expire sets the expiry of a key.
+func (m *InMemory) Expire(key string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.data[key]; !ok || m.expired(key) {
+		return store.ErrNotFound
+	}
+	m.expires[key] = time.Now().Add(ttl)
+	return nil
+}
+
+// TTL returns the time left before the key expires, 0 if it does not expire.
+func (m *InMemory) TTL(key string) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.data[key]; !ok || m.expired(key) {
+		return 0, store.ErrNotFound
+	}
+	exp, ok := m.expires[key]
+	if !ok {
+		return 0, nil
+	}
+	return time.Until(exp), nil
+}
+
+// Iterate calls fn for each key starting with prefix.
+// The store must not be accessed from within fn, its lock is held.
+func (m *InMemory) Iterate(prefix string, fn func(key string, data []byte) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, d := range m.data {
+		if !strings.HasPrefix(key, prefix) || m.expired(key) {
+			continue
+		}
+		if err := fn(key, d); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -69,5 +137,6 @@ func (m *InMemory) Delete(key string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	delete(m.data, key)
+	delete(m.expires, key)
 	return nil
 }
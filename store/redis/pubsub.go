@@ -0,0 +1,128 @@
+package redis
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// PubSub is a message broker publishing on a Redis pub/sub channel.
+type PubSub struct {
+	cfg     Config
+	channel string
+	pool    *redis.Pool
+	log     *log.Logger
+
+	mu     sync.Mutex
+	conn   redis.Conn
+	closed bool
+}
+
+// NewPubSub returns a new broker on the given channel.
+func NewPubSub(cfg Config, channel string, log *log.Logger) (*PubSub, error) {
+	if channel == "" {
+		return nil, errors.New("empty pub/sub channel")
+	}
+	pool := newPool(cfg)
+
+	// Test connection.
+	c := pool.Get()
+	defer c.Close()
+
+	if err := c.Err(); err != nil {
+		return nil, err
+	}
+	return &PubSub{cfg: cfg, channel: channel, pool: pool, log: log}, nil
+}
+
+// Publish a message on the channel.
+func (p *PubSub) Publish(msg []byte) error {
+	c := p.pool.Get()
+	defer c.Close()
+	_, err := c.Do("PUBLISH", p.channel, msg)
+	return err
+}
+
+// Subscribe to the channel, fn is called for each message received.
+// The subscription is restored when the connection drops until Close is called.
+func (p *PubSub) Subscribe(fn func(msg []byte)) error {
+	conn, err := p.subscribe()
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			p.receive(conn, fn)
+			for {
+				if p.isClosed() {
+					return
+				}
+				time.Sleep(time.Second)
+				if conn, err = p.subscribe(); err == nil {
+					break
+				}
+				p.log.Printf("error subscribing to %q: %v", p.channel, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// subscribe opens a dedicated connection subscribed to the channel.
+// It does not time out on reads as the channel may be quiet.
+func (p *PubSub) subscribe() (redis.PubSubConn, error) {
+	c, err := dial(p.cfg, 0)
+	if err != nil {
+		return redis.PubSubConn{}, err
+	}
+	conn := redis.PubSubConn{Conn: c}
+	if err := conn.Subscribe(p.channel); err != nil {
+		c.Close()
+		return redis.PubSubConn{}, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		c.Close()
+		return redis.PubSubConn{}, errors.New("pub/sub is closed")
+	}
+	p.conn = c
+	return conn, nil
+}
+
+// receive messages until the connection fails.
+func (p *PubSub) receive(conn redis.PubSubConn, fn func(msg []byte)) {
+	defer conn.Close()
+	for {
+		switch v := conn.Receive().(type) {
+		case redis.Message:
+			fn(v.Data)
+		case error:
+			if !p.isClosed() {
+				p.log.Printf("error receiving from %q: %v", p.channel, v)
+			}
+			return
+		}
+	}
+}
+
+func (p *PubSub) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+// Close the subscription and the connections.
+func (p *PubSub) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	if p.conn != nil {
+		p.conn.Close()
+	}
+	p.mu.Unlock()
+	return p.pool.Close()
+}
@@ -1,9 +1,11 @@
 package redis
 
 import (
+	"strings"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
+	"github.com/knadh/niltalk/store"
 )
 
 // Config represents the Redis store config structure.
@@ -25,31 +27,9 @@ type Redis struct {
 	pool *redis.Pool
 }
 
-type room struct {
-	ID        string `redis:"id"`
-	Name      string `redis:"name"`
-	Password  []byte `redis:"password"`
-	CreatedAt string `redis:"created_at"`
-}
-
 // New returns a new Redis store.
 func New(cfg Config) (*Redis, error) {
-	pool := &redis.Pool{
-		Wait:      true,
-		MaxActive: cfg.ActiveConns,
-		MaxIdle:   cfg.IdleConns,
-		Dial: func() (redis.Conn, error) {
-			return redis.Dial(
-				"tcp",
-				cfg.Address,
-				redis.DialPassword(cfg.Password),
-				redis.DialConnectTimeout(cfg.Timeout),
-				redis.DialReadTimeout(cfg.Timeout),
-				redis.DialWriteTimeout(cfg.Timeout),
-				redis.DialDatabase(cfg.DB),
-			)
-		},
-	}
+	pool := newPool(cfg)
 
 	// Test connection.
 	c := pool.Get()
@@ -61,11 +41,40 @@ func New(cfg Config) (*Redis, error) {
 	return &Redis{cfg: &cfg, pool: pool}, nil
 }
 
+// newPool returns a connection pool to the configured Redis server.
+func newPool(cfg Config) *redis.Pool {
+	return &redis.Pool{
+		Wait:      true,
+		MaxActive: cfg.ActiveConns,
+		MaxIdle:   cfg.IdleConns,
+		Dial: func() (redis.Conn, error) {
+			return dial(cfg, cfg.Timeout)
+		},
+	}
+}
+
+// dial connects to the configured Redis server.
+func dial(cfg Config, readTimeout time.Duration) (redis.Conn, error) {
+	return redis.Dial(
+		"tcp",
+		cfg.Address,
+		redis.DialPassword(cfg.Password),
+		redis.DialConnectTimeout(cfg.Timeout),
+		redis.DialReadTimeout(readTimeout),
+		redis.DialWriteTimeout(cfg.Timeout),
+		redis.DialDatabase(cfg.DB),
+	)
+}
+
 // Get value from a key.
 func (r *Redis) Get(key string) ([]byte, error) {
 	c := r.pool.Get()
 	defer c.Close()
-	return redis.Bytes(c.Do("GET", key))
+	b, err := redis.Bytes(c.Do("GET", key))
+	if err == redis.ErrNil {
+		return nil, store.ErrNotFound
+	}
+	return b, err
 }
 
 // Set a value.
@@ -76,6 +85,112 @@ func (r *Redis) Set(key string, data []byte) error {
 	return err
 }
 
+// SetWithTTL sets a value that expires after ttl. Like the other stores,
+// the key is gone at once if ttl is not positive.
+func (r *Redis) SetWithTTL(key string, data []byte, ttl time.Duration) error {
+	c := r.pool.Get()
+	defer c.Close()
+	var err error
+	if expiresNow(ttl) {
+		_, err = c.Do("DEL", key)
+	} else {
+		_, err = c.Do("SET", key, data, "PX", ttl.Milliseconds())
+	}
+	return err
+}
+
+// Reserve sets a value that expires after ttl if the key does not exist.
+// If ttl is not positive, nothing is set and it only reports whether the
+// key does not exist.
+func (r *Redis) Reserve(key string, data []byte, ttl time.Duration) (bool, error) {
+	c := r.pool.Get()
+	defer c.Close()
+	if expiresNow(ttl) {
+		exists, err := redis.Bool(c.Do("EXISTS", key))
+		return !exists, err
+	}
+	res, err := c.Do("SET", key, data, "PX", ttl.Milliseconds(), "NX")
+	if err != nil {
+		return false, err
+	}
+	// SET NX replies nil if the key exists.
+	return res != nil, nil
+}
+
+// expiresNow returns true if a key set with ttl expires at once. PX rejects
+// the durations under a millisecond.
+func expiresNow(ttl time.Duration) bool {
+	return ttl < time.Millisecond
+}
+
+// Expire sets the expiry of a key, PEXPIRE deletes it if ttl is not positive.
+func (r *Redis) Expire(key string, ttl time.Duration) error {
+	c := r.pool.Get()
+	defer c.Close()
+	ok, err := redis.Bool(c.Do("PEXPIRE", key, ttl.Milliseconds()))
+	if err == nil && !ok {
+		err = store.ErrNotFound
+	}
+	return err
+}
+
+// TTL returns the time left before the key expires, 0 if it does not expire.
+func (r *Redis) TTL(key string) (time.Duration, error) {
+	c := r.pool.Get()
+	defer c.Close()
+	ms, err := redis.Int64(c.Do("PTTL", key))
+	if err != nil {
+		return 0, err
+	}
+	switch ms {
+	case -2:
+		return 0, store.ErrNotFound
+	case -1:
+		return 0, nil
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// Iterate calls fn for each key starting with prefix.
+func (r *Redis) Iterate(prefix string, fn func(key string, data []byte) error) error {
+	c := r.pool.Get()
+	defer c.Close()
+
+	match := globEscaper.Replace(prefix) + "*"
+	cursor := 0
+	for {
+		res, err := redis.Values(c.Do("SCAN", cursor, "MATCH", match, "COUNT", 100))
+		if err != nil {
+			return err
+		}
+		if cursor, err = redis.Int(res[0], nil); err != nil {
+			return err
+		}
+		keys, err := redis.Strings(res[1], nil)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			d, err := redis.Bytes(c.Do("GET", key))
+			if err == redis.ErrNil {
+				// Expired or deleted meanwhile.
+				continue
+			} else if err != nil {
+				return err
+			}
+			if err := fn(key, d); err != nil {
+				return err
+			}
+		}
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// globEscaper escapes the special characters of a redis glob pattern.
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
 // Delete a value.
 func (r *Redis) Delete(key string) error {
 	c := r.pool.Get()
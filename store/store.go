@@ -5,18 +5,75 @@ import (
 	"time"
 )
 
-// Store represents a backend store.
+// Store represents a backend store. The keys embed room IDs, so errors
+// must not include them as they end up in the logs.
 type Store interface {
 	Get(key string) ([]byte, error)
 	Set(key string, value []byte) error
+	// SetWithTTL sets a value that expires after the given duration,
+	// at once if it is not positive.
+	SetWithTTL(key string, value []byte, ttl time.Duration) error
+	// Expire sets the expiry of an existing key, a duration that is not
+	// positive expires it at once.
+	Expire(key string, ttl time.Duration) error
 	Delete(key string) error
 }
 
+// Iterator is implemented by the stores able to enumerate their keys.
+type Iterator interface {
+	// Iterate calls fn for each key starting with prefix.
+	Iterate(prefix string, fn func(key string, value []byte) error) error
+}
+
+// TTLReader is implemented by the stores able to report the expiry of their keys.
+type TTLReader interface {
+	// TTL returns the time left before the key expires, 0 if it does not expire.
+	TTL(key string) (time.Duration, error)
+}
+
+// Reserver is implemented by the stores shared by several instances,
+// to claim a key atomically across them.
+type Reserver interface {
+	// Reserve sets a value that expires after the given duration if the key
+	// does not exist, and returns false otherwise.
+	Reserve(key string, value []byte, ttl time.Duration) (bool, error)
+}
+
 // Sess represents an authenticated peer session.
 type Sess struct {
 	PublicKey string    `json:"pk"`
 	Since     time.Time `json:"since"`
 }
 
+// Room represents the metadata of an ad-hoc room persisted in the store
+// so that it survives restarts.
+type Room struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Password  []byte    `json:"password"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	// Lifecycle options the room was created with, and the time
+	// it burns at once its first peer joined.
+	IdleTimeout time.Duration `json:"idle_timeout"`
+	DestroyAt   time.Time     `json:"destroy_at"`
+	BurnAfter   time.Duration `json:"burn_after"`
+	BurnAt      time.Time     `json:"burn_at"`
+	// MessageTTL is the longest lifetime of the messages of the room.
+	MessageTTL time.Duration `json:"message_ttl"`
+
+	// Owner is the public key of the peer administrating the room,
+	// OwnerToken the hash of the token its creator claims it with.
+	Owner      string   `json:"owner"`
+	OwnerToken []byte   `json:"owner_token"`
+	Banned     []string `json:"banned"`
+	Muted      []string `json:"muted"`
+}
+
+// ErrNotFound is returned by the stores when a key does not exist or
+// has expired.
+var ErrNotFound = errors.New("key not found")
+
 // ErrRoomNotFound indicates that the requested room was not found.
 var ErrRoomNotFound = errors.New("room not found")
@@ -9,12 +9,13 @@ import (
 )
 
 func (a *App) getTpl() (*template.Template, error) {
+	theme := a.hub.Config().Theme
 	if a.jit {
-		return a.buildTheme(a.cfg.Theme)
+		return a.buildTheme(theme)
 	}
-	tpl, ok := a.tpls[a.cfg.Theme]
+	tpl, ok := a.tpls[theme]
 	if !ok {
-		return nil, fmt.Errorf("theme %q not found", a.cfg.Theme)
+		return nil, fmt.Errorf("theme %q not found", theme)
 	}
 	return tpl, nil
 }
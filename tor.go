@@ -6,6 +6,7 @@ import (
 	"crypto/rand"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -17,6 +18,7 @@ import (
 	"github.com/cretz/bine/tor"
 	"github.com/cretz/bine/torutil"
 	tued25519 "github.com/cretz/bine/torutil/ed25519"
+	"github.com/knadh/niltalk/internal/metrics"
 	"github.com/knadh/niltalk/store"
 )
 
@@ -45,6 +47,9 @@ func pemEncodeKey(privateKey ed25519.PrivateKey) ([]byte, error) {
 
 func pemDecodeKey(d []byte) (ed25519.PrivateKey, error) {
 	block, _ := pem.Decode(d)
+	if block == nil {
+		return nil, errors.New("invalid PEM encoded key")
+	}
 	x509Encoded := block.Bytes
 	tPk, err := x509.ParsePKCS8PrivateKey(x509Encoded)
 	if err != nil {
@@ -57,10 +62,16 @@ func pemDecodeKey(d []byte) (ed25519.PrivateKey, error) {
 	return privateKey, nil
 }
 
-func getOrCreatePK(store store.Store) (ed25519.PrivateKey, error) {
+// getOrCreatePK returns the onion key of the store, generated on first use.
+// A key that can not be read is not replaced, that would change the address
+// of the hidden service.
+func getOrCreatePK(s store.Store) (ed25519.PrivateKey, error) {
 	key := "onionkey"
-	d, err := store.Get(key)
-	if len(d) == 0 || err != nil {
+	d, err := s.Get(key)
+	if err != nil && err != store.ErrNotFound {
+		return nil, fmt.Errorf("error reading the onion key: %v", err)
+	}
+	if len(d) == 0 {
 		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
 		if err != nil {
 			return nil, err
@@ -69,7 +80,7 @@ func getOrCreatePK(store store.Store) (ed25519.PrivateKey, error) {
 		if err != nil {
 			return nil, err
 		}
-		err = store.Set(key, pemEncoded)
+		err = s.Set(key, pemEncoded)
 		return privateKey, err
 	}
 	privateKey, err := pemDecodeKey(d)
@@ -97,6 +108,9 @@ func getOrCreatePKFile(fpath string) (ed25519.PrivateKey, error) {
 	return privateKey, err
 }
 
+// metricOnionPublished is 1 once the onion service is published.
+var metricOnionPublished = metrics.NewGauge("niltalk_tor_onion_published", "Whether the onion service is published.")
+
 type torServer struct {
 	Torrc   string
 	Handler http.Handler
@@ -104,6 +118,7 @@ type torServer struct {
 	PrivateKey ed25519.PrivateKey
 	tor        *tor.Tor
 	onion      *tor.OnionService
+	srv        http.Server
 }
 
 func onionAddr(pk ed25519.PrivateKey) string {
@@ -144,9 +159,20 @@ func (ts *torServer) Serve(ln net.Listener) error {
 		return fmt.Errorf("unable to create onion service: %v", err)
 	}
 	ts.onion = onion
-	return http.Serve(ts.onion, ts.Handler)
+	metricOnionPublished.Set(1)
+	ts.srv.Handler = ts.Handler
+	return ts.srv.Serve(ts.onion)
+}
+
+// Shutdown gracefully stops serving, then closes the onion service and tor.
+func (ts *torServer) Shutdown(ctx context.Context) error {
+	if err := ts.srv.Shutdown(ctx); err != nil {
+		return err
+	}
+	return ts.Close()
 }
 func (ts *torServer) Close() error {
+	metricOnionPublished.Set(0)
 	if ts.onion != nil {
 		if err := ts.onion.Close(); err != nil {
 			return err